@@ -6,7 +6,10 @@ import "fmt"
 import "net/http"
 import "net/url"
 import "database/sql"
+import "sort"
 import "strconv"
+import "strings"
+import "time"
 
 type AlertFunc func(string, *Check, *CheckResult, *sql.DB) error
 var alertFuncs map[string]AlertFunc
@@ -24,6 +27,40 @@ func DoAlert(alert *Alert, check *Check, result *CheckResult, db *sql.DB) error
 	}
 }
 
+// sortedKeys returns the keys of the map in order, so that alerts for the same
+// result are formatted identically.
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// order in which the well-known timings are listed; others follow sorted
+var timingOrder = []string{TimingDNS, TimingConnect, TimingTLS, TimingFirstByte, TimingRttMin, TimingRttAvg, TimingRttMax, TimingJitter}
+
+// sortedTimingKeys returns the keys of the timings in display order.
+func sortedTimingKeys(timings map[string]time.Duration) []string {
+	known := make(map[string]bool)
+	var keys []string
+	for _, k := range timingOrder {
+		known[k] = true
+		if _, ok := timings[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	var others []string
+	for k := range timings {
+		if !known[k] {
+			others = append(others, k)
+		}
+	}
+	sort.Strings(others)
+	return append(keys, others...)
+}
+
 func alertInit() {
 	alertFuncs = make(map[string]AlertFunc)
 
@@ -36,19 +73,38 @@ func alertInit() {
 		} else {
 			body = fmt.Sprintf("Check [%s] is now %s: %s", check.Name, result.Status, result.Message)
 		}
+		if result.Duration > 0 {
+			body += fmt.Sprintf("\nResponse time: %v", roundDuration(result.Duration))
+		}
+		if len(result.Timings) > 0 {
+			var timings []string
+			for _, k := range sortedTimingKeys(result.Timings) {
+				timings = append(timings, fmt.Sprintf("%s %v", k, roundDuration(result.Timings[k])))
+			}
+			body += "\nTimings: " + strings.Join(timings, ", ")
+		}
+		for _, k := range sortedKeys(result.Details) {
+			body += fmt.Sprintf("\n%s: %s", k, result.Details[k])
+		}
 		body += fmt.Sprintf("\n\nID: %d\nName: %s\nType: %s\nData: %s\n\ngobearmon", check.Id, check.Name, check.Type, check.Data)
 		return mail(subject, body, data)
 	}
 
 	alertFuncs["http"] = func(data string, check *Check, result *CheckResult, db *sql.DB) error {
-		resp, err := http.PostForm(data, url.Values{
+		values := url.Values{
 			"check_id": {strconv.Itoa(int(check.Id))},
 			"name": {check.Name},
 			"type": {check.Type},
 			"data": {check.Data},
 			"status": {string(result.Status)},
 			"message": {result.Message},
-		})
+			"response_time": {strconv.FormatInt(int64(result.Duration / time.Millisecond), 10)},
+		}
+		// each timing in milliseconds, e.g. timing_dns
+		for k, v := range result.Timings {
+			values.Set("timing_" + k, strconv.FormatInt(int64(v / time.Millisecond), 10))
+		}
+		resp, err := http.PostForm(data, values)
 		if err != nil {
 			return err
 		}
@@ -1,37 +1,115 @@
 package gobearmon
 
 import "bufio"
+import "context"
 import "crypto/tls"
+import "crypto/x509"
 import "encoding/json"
 import "errors"
 import "fmt"
-import "io"
-import "io/ioutil"
 import "net"
-import "net/http"
-import "os/exec"
-import "strconv"
+import "net/http/httptrace"
+import "net/url"
 import "strings"
+import "sync"
 import "time"
 
 import "github.com/miekg/dns"
 
-type CheckFunc func(string) error
-var checkFuncs map[string]CheckFunc
+// maximum time that a single check execution may take
+// the controller releases check locks after two minutes, so this should be
+// comfortably lower than that
+const checkTimeout = 90 * time.Second
+
+// Checker implements a check type.
+//
+// Parse is called when the controller loads check definitions from the
+// database; it decodes and validates the JSON-encoded check data, and returns
+// the parameters that are later passed to Run. A check whose data fails to
+// parse is not scheduled. Run performs the check, and should return promptly
+// when the context is cancelled. A nil error means the check is online.
+//
+// Run may fill in the Duration and Timings of the result; if Duration is left
+// unset, it is set to the time spent in Run. Parameters that embed
+// ResponseTimeParams fail the check when Duration exceeds the configured limit.
+type Checker interface {
+	Parse(data string) (interface{}, error)
+	Run(ctx context.Context, params interface{}, result *CheckResult) error
+	Describe() string
+}
 
-func DoCheck(check *Check) *CheckResult {
-	if checkFuncs == nil {
-		checkInit()
+type responseTimeLimiter interface {
+	responseTimeLimit() time.Duration
+}
+
+var checkersMu sync.RWMutex
+var checkers = make(map[string]Checker)
+
+// RegisterChecker makes a check type available under the given name, which
+// corresponds to the type column of the checks table. It panics if the name is
+// already registered.
+func RegisterChecker(name string, checker Checker) {
+	checkersMu.Lock()
+	defer checkersMu.Unlock()
+	if checker == nil {
+		panic("gobearmon: RegisterChecker checker is nil")
+	} else if _, exists := checkers[name]; exists {
+		panic("gobearmon: RegisterChecker called twice for check type " + name)
 	}
+	checkers[name] = checker
+}
+
+// GetChecker returns the checker registered under the given name, or nil.
+func GetChecker(name string) Checker {
+	checkersMu.RLock()
+	defer checkersMu.RUnlock()
+	return checkers[name]
+}
 
+// ParseCheck validates the check type and data, and returns the parsed
+// parameters.
+func ParseCheck(checkType string, data string) (interface{}, error) {
+	checker := GetChecker(checkType)
+	if checker == nil {
+		return nil, errors.New("invalid check type: " + checkType)
+	}
+	params, err := checker.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if limiter, ok := params.(responseTimeLimiter); ok && limiter.responseTimeLimit() < 0 {
+		return nil, errors.New("max_response_time must be non-negative")
+	}
+	return params, nil
+}
+
+func DoCheck(check *Check) *CheckResult {
 	var result CheckResult
-	f := checkFuncs[check.Type]
+	checker := GetChecker(check.Type)
 
-	if f == nil {
+	if checker == nil {
 		result.Status = "offline"
 		result.Message = "invalid check type: " + check.Type
 	} else {
-		err := f(check.Data)
+		params := check.Params
+		var err error
+		if params == nil {
+			params, err = checker.Parse(check.Data)
+		}
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+			start := time.Now()
+			err = checker.Run(ctx, params, &result)
+			if result.Duration == 0 {
+				result.Duration = time.Since(start)
+			}
+			cancel()
+		}
+		if err == nil {
+			if limiter, ok := params.(responseTimeLimiter); ok && limiter.responseTimeLimit() > 0 && result.Duration > limiter.responseTimeLimit() {
+				err = fmt.Errorf("response time %v exceeds maximum of %v", roundDuration(result.Duration), limiter.responseTimeLimit())
+			}
+		}
 		if err == nil {
 			result.Status = "online"
 		} else {
@@ -44,262 +122,656 @@ func DoCheck(check *Check) *CheckResult {
 	return &result
 }
 
-func checkInit() {
-	checkFuncs = make(map[string]CheckFunc)
+func init() {
+	RegisterChecker("http", httpChecker{})
+	RegisterChecker("http_flow", httpFlowChecker{})
+	RegisterChecker("tcp", tcpChecker{})
+	RegisterChecker("udp", udpChecker{})
+	RegisterChecker("ntp", ntpChecker{})
+	RegisterChecker("smtp", smtpChecker{})
+	RegisterChecker("mail_roundtrip", mailRoundtripChecker{})
+	RegisterChecker("mysql", sqlChecker{driver: "mysql", defaultPort: "3306"})
+	RegisterChecker("postgres", sqlChecker{driver: "postgres", defaultPort: "5432"})
+	RegisterChecker("redis", redisChecker{})
+	RegisterChecker("icmp", icmpChecker{})
+	RegisterChecker("ssl_expire", sslExpireChecker{})
+	RegisterChecker("tls_policy", tlsPolicyChecker{})
+	RegisterChecker("domain_expire", domainExpireChecker{})
+	RegisterChecker("dns", dnsChecker{})
+	RegisterChecker("dns_zone", dnsZoneChecker{})
+	RegisterChecker("dnssec", dnssecChecker{})
+	RegisterChecker("heartbeat", heartbeatChecker{})
+}
 
-	checkFuncs["http"] = func(data string) error {
-		var params HttpCheckParams
-		err := json.Unmarshal([]byte(data), &params)
-		if err != nil {
-			return fmt.Errorf("failed to decode check parameters: %v", err)
-		}
-
-		// fix parameters
-		if params.Timeout == 0 {
-			params.Timeout = 10
-		} else if params.Timeout < 3 {
-			params.Timeout = 3
-		} else if params.Timeout > 30 {
-			params.Timeout = 30
-		}
-		if params.Method == "" {
-			if params.Body == "" {
-				params.Method = "GET"
-			} else {
-				params.Method = "POST"
-			}
-		}
+func decodeParams(data string, params interface{}) error {
+	err := json.Unmarshal([]byte(data), params)
+	if err != nil {
+		return fmt.Errorf("failed to decode check parameters: %v", err)
+	}
+	return nil
+}
 
-		client := &http.Client{
-			Timeout: time.Duration(params.Timeout) * time.Second,
-			Transport: &http.Transport{
-				DisableKeepAlives: true,
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: params.Insecure,
-				},
-			},
-		}
+// roundDuration rounds a duration for display in messages
+func roundDuration(d time.Duration) time.Duration {
+	if d < 10 * time.Millisecond && d > -10 * time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(time.Millisecond)
+}
 
-		var body io.ReadCloser
-		if len(params.Body) > 0 {
-			body = ioutil.NopCloser(strings.NewReader(params.Body))
-		}
+func clampTimeout(timeout int) int {
+	if timeout == 0 {
+		return 10
+	} else if timeout < 3 {
+		return 3
+	} else if timeout > 30 {
+		return 30
+	}
+	return timeout
+}
 
-		request, err := http.NewRequest(params.Method, params.Url, body)
-		if err != nil {
-			return fmt.Errorf("error creating HTTP request: %v", err)
-		}
+func validateForceIP(forceIP int) error {
+	if forceIP != 0 && forceIP != 4 && forceIP != 6 {
+		return fmt.Errorf("force_ip must be 4 or 6, got %d", forceIP)
+	}
+	return nil
+}
+
+func validateAddress(address string) error {
+	if address == "" {
+		return errors.New("address is required")
+	}
+	_, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %s: %v", address, err)
+	}
+	return nil
+}
+
+// withDefaultPort adds the port to an address that has none, including bare
+// IPv6 literals such as 2001:db8::1.
+func withDefaultPort(address string, port string) string {
+	if address == "" {
+		return address
+	} else if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(strings.Trim(address, "[]"), port)
+	}
+	return address
+}
 
-		request.Header = http.Header{"User-Agent": {"gobearmon"}}
-		for k, v := range params.Headers {
-			if k == "Host" {
-				request.Host = v
-			} else {
-				request.Header.Set(k, v)
+type httpChecker struct{}
+
+func (this httpChecker) Describe() string {
+	return "HTTP request, optionally verifying the status code or a substring of the response body"
+}
+
+func (this httpChecker) Parse(data string) (interface{}, error) {
+	var params HttpCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := params.prepareRequest(false); err != nil {
+		return nil, err
+	} else if err := params.prepareClient(); err != nil {
+		return nil, err
+	}
+
+	return &params, nil
+}
+
+func (this httpChecker) Run(ctx context.Context, p interface{}, result *CheckResult) (err error) {
+	params := p.(*HttpCheckParams)
+
+	// include the redirect chain in any failure message
+	chain := []string{params.Url}
+	defer func() {
+		if err != nil && len(chain) > 1 {
+			err = fmt.Errorf("%v (redirect chain: %s)", err, strings.Join(chain, " -> "))
+		}
+	}()
+	client := params.newClient(&chain, nil)
+
+	// set the timings last, after the response body is closed
+	timings := newHttpTimings(time.Now())
+	defer func() {
+		result.Timings = timings.finish()
+	}()
+	request, err := params.newRequest(httptrace.WithClientTrace(ctx, timings.trace()), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("error performing HTTP request: %v", err)
+	}
+	defer response.Body.Close()
+
+	if len(chain) > 1 {
+		result.Details = map[string]string{"final_url": response.Request.URL.String()}
+	}
+
+	body, err := params.readBody(response, false)
+	if err != nil {
+		return err
+	}
+	return params.verify(response, body)
+}
+
+type tcpChecker struct{}
+
+func (this tcpChecker) Describe() string {
+	return "TCP connection, optionally over TLS, sending a payload and verifying the response line"
+}
+
+func (this tcpChecker) Parse(data string) (interface{}, error) {
+	var params TcpCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateAddress(params.Address); err != nil {
+		return nil, err
+	} else if err := validateForceIP(params.ForceIP); err != nil {
+		return nil, err
+	} else if err := params.compile(); err != nil {
+		return nil, err
+	} else if err := params.loadTls(); err != nil {
+		return nil, err
+	}
+	if len(params.Script) > 0 {
+		if params.Payload != "" || params.Expect != "" || params.active() {
+			return nil, errors.New("script cannot be combined with payload or expect options")
+		} else if len(params.Script) > maxTcpScriptSteps {
+			return nil, fmt.Errorf("at most %d script steps are allowed", maxTcpScriptSteps)
+		}
+		for i, step := range params.Script {
+			if step == nil {
+				return nil, fmt.Errorf("script step %d is null", i + 1)
+			} else if err := step.prepare(); err != nil {
+				return nil, fmt.Errorf("script step %d: %v", i + 1, err)
 			}
 		}
+	}
+	if params.StartTls != "" {
+		if params.Tls {
+			return nil, errors.New("tls and starttls cannot both be set")
+		} else if err := validateStartTls(params.StartTls); err != nil {
+			return nil, err
+		}
+	}
 
-		if params.Username != "" {
-			request.SetBasicAuth(params.Username, params.Password)
+	params.Timeout = clampTimeout(params.Timeout)
+	var total int
+	for _, step := range params.Script {
+		if step.Timeout != 0 {
+			total += step.Timeout
+		} else {
+			total += params.Timeout
 		}
+	}
+	if time.Duration(total) * time.Second > checkTimeout {
+		return nil, fmt.Errorf("script may take up to %d seconds, reduce the number of steps or the timeouts", total)
+	}
+	return &params, nil
+}
+
+func (this tcpChecker) Run(ctx context.Context, p interface{}, result *CheckResult) error {
+	params := p.(*TcpCheckParams)
+	timeout := time.Duration(params.Timeout) * time.Second
+
+	network := "tcp"
+	if params.ForceIP == 4 {
+		network = "tcp4"
+	} else if params.ForceIP == 6 {
+		network = "tcp6"
+	}
 
-		response, err := client.Do(request)
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, params.Address)
+	if err != nil {
+		return fmt.Errorf("TCP connection error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	in := bufio.NewReader(conn)
+
+	if params.Tls || params.StartTls != "" {
+		host, _, _ := net.SplitHostPort(params.Address)
+		tlsConfig := params.tlsConfig(host)
+		if params.StartTls != "" {
+			err := startTls(params.StartTls, conn, in, tlsConfig.ServerName)
+			if err != nil {
+				return err
+			}
+		}
+		tlsConn, err := tlsHandshake(ctx, conn, tlsConfig)
 		if err != nil {
-			return fmt.Errorf("error performing HTTP request: %v", err)
+			return err
 		}
-		defer response.Body.Close()
+		conn = tlsConn
+		in = bufio.NewReader(conn)
+		result.Details = map[string]string{"tls_version": tls.VersionName(tlsConn.ConnectionState().Version)}
+	}
 
-		if params.ExpectStatus != 0 && params.ExpectStatus != response.StatusCode {
-			return fmt.Errorf("status mismatch, got %d but expected %d", response.StatusCode, params.ExpectStatus)
+	for i, step := range params.Script {
+		err := step.run(conn, in, timeout)
+		if err != nil {
+			return fmt.Errorf("script step %d: %v", i + 1, err)
 		}
+	}
 
-		if params.ExpectSubstring != "" {
-			bytes, err := ioutil.ReadAll(response.Body)
+	if params.Expect != "" || params.active() {
+		if params.Payload != "" {
+			_, err := conn.Write([]byte(params.Payload + "\n"))
 			if err != nil {
-				return fmt.Errorf("error reading HTTP response body: %v", err)
+				return fmt.Errorf("failed to send payload: %v", err)
 			}
+		}
 
-			if !strings.Contains(string(bytes), params.ExpectSubstring) {
-				return fmt.Errorf("expected substring [%s] was not found in the response body", params.ExpectSubstring)
-			}
+		str, err := in.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read response: %v", err)
+		} else if !strings.Contains(str, params.Expect) {
+			return fmt.Errorf("response mismatch, expected [%s] but got [%s]", params.Expect, strings.TrimSpace(str))
+		} else if err := params.match(str, "response"); err != nil {
+			return err
 		}
+	}
 
-		return nil
+	return nil
+}
+
+type icmpChecker struct{}
+
+func (this icmpChecker) Describe() string {
+	return "ICMP ping, optionally failing on packet loss, round-trip time or jitter"
+}
+
+func (this icmpChecker) Parse(data string) (interface{}, error) {
+	var params IcmpCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
 	}
 
-	checkFuncs["tcp"] = func(data string) error {
-		var params TcpCheckParams
-		err := json.Unmarshal([]byte(data), &params)
-		if err != nil {
-			return fmt.Errorf("failed to decode check parameters: %v", err)
-		}
+	if params.Target == "" {
+		return nil, errors.New("target is required")
+	} else if err := validateForceIP(params.ForceIP); err != nil {
+		return nil, err
+	} else if params.MaxPacketLoss != nil && (*params.MaxPacketLoss < 0 || *params.MaxPacketLoss > 100) {
+		return nil, fmt.Errorf("max_packet_loss must be a percentage, got %d", *params.MaxPacketLoss)
+	} else if params.MaxRtt < 0 || params.MaxJitter < 0 {
+		return nil, errors.New("max_rtt and max_jitter must be non-negative")
+	}
 
-		if params.Timeout == 0 {
-			params.Timeout = 10
-		} else if params.Timeout < 3 {
-			params.Timeout = 3
-		} else if params.Timeout > 30 {
-			params.Timeout = 30
-		}
+	// fix parameters
+	if params.Count <= 0 {
+		params.Count = 5
+	} else if params.Count > 100 {
+		params.Count = 100
+	}
+	if params.Interval == 0 {
+		params.Interval = 1000
+	} else if params.Interval < 200 {
+		params.Interval = 200
+	}
+	if params.Timeout <= 0 {
+		params.Timeout = 2
+	} else if params.Timeout > 10 {
+		params.Timeout = 10
+	}
+	if params.MaxPacketLoss == nil {
+		// packetloss is the legacy option, which used to fail the check on
+		//  more than 30% packet loss; otherwise we fail only if all are lost
+		maxPacketLoss := 99
+		if params.PacketLoss {
+			maxPacketLoss = 30
+		}
+		params.MaxPacketLoss = &maxPacketLoss
+	}
 
-		network := "tcp"
-		if params.ForceIP == 4 {
-			network = "tcp4"
-		} else if params.ForceIP == 6 {
-			network = "tcp6"
-		}
+	if total := (params.Count - 1) * params.Interval + params.Timeout * 1000; time.Duration(total) * time.Millisecond > checkTimeout / 2 {
+		return nil, fmt.Errorf("ping would take up to %d seconds, reduce count or interval", total / 1000)
+	}
 
-		conn, err := net.DialTimeout(network, params.Address, time.Duration(params.Timeout) * time.Second)
-		if err != nil {
-			return fmt.Errorf("TCP connection error: %v", err)
-		}
-		defer conn.Close()
+	return &params, nil
+}
 
-		if params.Expect != "" {
-			if params.Payload != "" {
-				_, err := conn.Write([]byte(params.Payload + "\n"))
-				if err != nil {
-					return fmt.Errorf("failed to send payload: %v", err)
-				}
-			}
+func (this icmpChecker) Run(ctx context.Context, p interface{}, result *CheckResult) error {
+	params := p.(*IcmpCheckParams)
 
-			in := bufio.NewReader(conn)
-			str, err := in.ReadString('\n')
-			if err != nil {
-				return fmt.Errorf("failed to read response: %v", err)
-			} else if !strings.Contains(str, params.Expect) {
-				return fmt.Errorf("response mismatch, expected [%s] but got [%s]", params.Expect, strings.TrimSpace(str))
-			}
-		}
+	ip, err := resolvePingTarget(ctx, params.Target, params.ForceIP)
+	if err != nil {
+		return err
+	}
+	stats, err := ping(ctx, ip, params.Count, time.Duration(params.Interval) * time.Millisecond, time.Duration(params.Timeout) * time.Second)
+	if err != nil {
+		return fmt.Errorf("ping %s: %v", ip, err)
+	}
 
-		return nil
+	if stats.Received > 0 {
+		result.Duration = stats.Avg
+	}
+	result.Timings = map[string]time.Duration{
+		TimingRttMin: stats.Min,
+		TimingRttAvg: stats.Avg,
+		TimingRttMax: stats.Max,
+		TimingJitter: stats.Jitter,
+	}
+	result.Details = map[string]string{
+		"address": ip.String(),
+		"packet_loss": fmt.Sprintf("%d%%", stats.Loss()),
 	}
 
-	checkFuncs["icmp"] = func(data string) error {
-		var params IcmpCheckParams
-		err := json.Unmarshal([]byte(data), &params)
-		if err != nil {
-			return fmt.Errorf("failed to decode check parameters: %v", err)
-		}
+	if stats.Received == 0 || stats.Loss() > *params.MaxPacketLoss {
+		return fmt.Errorf("ping %s: %d%% packet loss (%s)", ip, stats.Loss(), stats)
+	} else if params.MaxRtt > 0 && stats.Max > time.Duration(params.MaxRtt) * time.Millisecond {
+		return fmt.Errorf("ping %s: maximum rtt %v exceeds %dms (%s)", ip, roundDuration(stats.Max), params.MaxRtt, stats)
+	} else if params.MaxJitter > 0 && stats.Jitter > time.Duration(params.MaxJitter) * time.Millisecond {
+		return fmt.Errorf("ping %s: jitter %v exceeds %dms (%s)", ip, roundDuration(stats.Jitter), params.MaxJitter, stats)
+	}
+	return nil
+}
 
-		command := "ping"
-		if params.ForceIP == 6 {
-			command = "ping6"
-		}
+type sslExpireChecker struct{}
 
-		if strings.ContainsAny(params.Target, "$&<>!/\\\"'") {
-			return errors.New("ping target contains invalid characters")
-		}
+func (this sslExpireChecker) Describe() string {
+	return "TLS certificate expiration, optionally verifying the chain, hostname and revocation status"
+}
 
-		cmd := exec.Command(command, "-c", "5", "-w", "10", "--", params.Target)
-		output, err := cmd.Output()
-		if err != nil {
-			// only fail if it is not an exit code based error
-			_, ok := err.(*exec.ExitError)
-			if !ok {
-				return fmt.Errorf("failed to run ping command: %v", err)
-			}
-		}
+func (this sslExpireChecker) Parse(data string) (interface{}, error) {
+	var params SslExpireCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
 
-		lines := strings.Split(string(output), "\n")
-		for _, line := range lines {
-			parts := strings.Split(line, " received, ")
-			if len(parts) == 2 {
-				percentageString := strings.Split(parts[1], "% packet loss")[0]
-				percentage, err := strconv.Atoi(percentageString)
-				if err != nil {
-					return errors.New("failed to parse ping percent packet loss")
-				} else if percentage == 100 || (percentage > 30 && params.PacketLoss) {
-					return fmt.Errorf("ping: %d%% packet loss", percentage)
-				} else {
-					return nil
-				}
-			}
+	if err := validateAddress(params.Address); err != nil {
+		return nil, err
+	} else if params.Days < 0 {
+		return nil, fmt.Errorf("days must be non-negative, got %d", params.Days)
+	} else if params.Insecure {
+		return nil, errors.New("insecure is not supported, certificates are only verified if verify is set")
+	} else if err := params.loadTls(); err != nil {
+		return nil, err
+	}
+	if params.StartTls != "" {
+		if err := validateStartTls(params.StartTls); err != nil {
+			return nil, err
 		}
+	}
 
-		return errors.New("unknown ping output format")
+	// fix parameters
+	if params.RequireOcspStaple {
+		params.Ocsp = true
 	}
+	return &params, nil
+}
 
-	checkFuncs["ssl_expire"] = func(data string) error {
-		var params SslExpireCheckParams
-		err := json.Unmarshal([]byte(data), &params)
-		if err != nil {
-			return fmt.Errorf("failed to decode check parameters: %v", err)
-		}
+func (this sslExpireChecker) Run(ctx context.Context, p interface{}, result *CheckResult) error {
+	params := p.(*SslExpireCheckParams)
+	timeout := 15 * time.Second
+	host, _, _ := net.SplitHostPort(params.Address)
 
-		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 15 * time.Second}, "tcp", params.Address, &tls.Config{InsecureSkipVerify: true})
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", params.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// certificates are verified below, so that expiration can be reported
+	// even for certificates that fail verification
+	tlsConfig := params.tlsConfig(host)
+	tlsConfig.InsecureSkipVerify = true
+	if params.StartTls != "" {
+		err := startTls(params.StartTls, conn, bufio.NewReader(conn), tlsConfig.ServerName)
 		if err != nil {
 			return err
 		}
-		err = conn.Handshake()
-		if err != nil {
-			return err
+	}
+	tlsConn, err := tlsHandshake(ctx, conn, tlsConfig)
+	if err != nil {
+		return err
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no peer certificates found")
+	}
+	cert := state.PeerCertificates[0]
+	result.Details = map[string]string{"expires": cert.NotAfter.UTC().Format(time.RFC3339)}
+
+	certs := state.PeerCertificates[:1]
+	if params.CheckChain {
+		certs = state.PeerCertificates
+	}
+	for i, c := range certs {
+		daysRemaining := int(c.NotAfter.Sub(time.Now()).Hours() / 24)
+		if daysRemaining > params.Days {
+			continue
+		} else if i == 0 {
+			return fmt.Errorf("certificate (%s) expires in %d days", cert.Subject.CommonName, daysRemaining)
+		}
+		return fmt.Errorf("chain certificate %d (%s) expires in %d days", i, certificateName(c), daysRemaining)
+	}
+
+	var verifiedChain []*x509.Certificate
+	if params.Verify {
+		intermediates := x509.NewCertPool()
+		for _, c := range state.PeerCertificates[1:] {
+			intermediates.AddCert(c)
 		}
-		state := conn.ConnectionState()
-		if len(state.PeerCertificates) == 0 {
-			return errors.New("no peer certificates found")
+		chains, err := cert.Verify(x509.VerifyOptions{
+			Roots: tlsConfig.RootCAs,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return fmt.Errorf("certificate verification failed: %v", err)
 		}
-		cert := state.PeerCertificates[0]
-		daysRemaining := int(cert.NotAfter.Sub(time.Now()).Hours() / 24)
-		if daysRemaining <= params.Days {
-			return fmt.Errorf("certificate (%s) expires in %d days", cert.Subject.CommonName, daysRemaining)
+		verifiedChain = chains[0]
+	}
+	if params.VerifyHostname {
+		if err := cert.VerifyHostname(tlsConfig.ServerName); err != nil {
+			return fmt.Errorf("hostname verification failed: %v", err)
 		}
-		return nil
 	}
 
-	checkFuncs["dns"] = func(data string) error {
-		var params DnsCheckParams
-		err := json.Unmarshal([]byte(data), &params)
+	if params.Ocsp {
+		if params.RequireOcspStaple && len(state.OCSPResponse) == 0 {
+			return errors.New("server did not staple an OCSP response")
+		}
+		var issuer *x509.Certificate
+		if len(verifiedChain) > 1 {
+			issuer = verifiedChain[1]
+		} else if len(state.PeerCertificates) > 1 {
+			issuer = state.PeerCertificates[1]
+		} else {
+			return errors.New("server did not send the issuer certificate, which is needed to check the OCSP status")
+		}
+		source, err := ocspStatus(ctx, cert, issuer, state.OCSPResponse, timeout)
+		result.Details["ocsp"] = source
 		if err != nil {
-			return fmt.Errorf("failed to decode check parameters: %v", err)
+			return err
 		}
+	}
+
+	return nil
+}
+
+// certificateName returns the common name of a certificate, or the full
+// subject if it has none.
+func certificateName(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	return cert.Subject.String()
+}
+
+var dnsTypeMap = map[string]uint16{
+	"a": dns.TypeA,
+	"ns": dns.TypeNS,
+	"cname": dns.TypeCNAME,
+	"dname": dns.TypeDNAME,
+	"soa": dns.TypeSOA,
+	"ptr": dns.TypePTR,
+	"mx": dns.TypeMX,
+	"txt": dns.TypeTXT,
+	"aaaa": dns.TypeAAAA,
+	"srv": dns.TypeSRV,
+	"spf": dns.TypeSPF,
+	"naptr": dns.TypeNAPTR,
+	"caa": dns.TypeCAA,
+	"ds": dns.TypeDS,
+	"dnskey": dns.TypeDNSKEY,
+	"cds": dns.TypeCDS,
+	"cdnskey": dns.TypeCDNSKEY,
+	"rrsig": dns.TypeRRSIG,
+	"nsec": dns.TypeNSEC,
+	"nsec3param": dns.TypeNSEC3PARAM,
+	"tlsa": dns.TypeTLSA,
+	"sshfp": dns.TypeSSHFP,
+	"svcb": dns.TypeSVCB,
+	"https": dns.TypeHTTPS,
+	"loc": dns.TypeLOC,
+	"hinfo": dns.TypeHINFO,
+}
 
-		dnsTypeMap := map[string]uint16{
-			"a": dns.TypeA,
-			"ns": dns.TypeNS,
-			"soa": dns.TypeSOA,
-			"ptr": dns.TypePTR,
-			"mx": dns.TypeMX,
-			"txt": dns.TypeTXT,
-			"aaaa": dns.TypeAAAA,
-			"srv": dns.TypeSRV,
-			"spf": dns.TypeSPF,
+type dnsChecker struct{}
+
+func (this dnsChecker) Describe() string {
+	return "DNS query, optionally verifying the rcode, records, TTLs and authoritative flag"
+}
+
+func (this dnsChecker) Parse(data string) (interface{}, error) {
+	var params DnsCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Name == "" {
+		return nil, errors.New("name is required")
+	} else if _, ok := dnsTypeMap[strings.ToLower(params.Type)]; !ok {
+		return nil, fmt.Errorf("invalid record type: %s", params.Type)
+	} else if params.MinTtl != nil && params.MaxTtl != nil && *params.MinTtl > *params.MaxTtl {
+		return nil, errors.New("min_ttl cannot exceed max_ttl")
+	}
+	if params.Transport == "tls" || params.Transport == "https" {
+		if err := params.loadTls(); err != nil {
+			return nil, err
 		}
+	} else if params.Transport != "" && params.Transport != "udp" && params.Transport != "tcp" {
+		return nil, fmt.Errorf("invalid transport %s, expected udp, tcp, tls or https", params.Transport)
+	}
+	if params.Transport == "tls" && params.Server == "" {
+		// the configured resolver is usually a plain DNS server on port 53
+		return nil, errors.New("server is required for the tls transport")
+	}
+	if params.Transport == "https" {
+		u, err := url.Parse(params.Server)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, errors.New("server must be an https URL for the https transport")
+		}
+		params.DohMethod = strings.ToLower(params.DohMethod)
+		if params.DohMethod == "" {
+			params.DohMethod = "post"
+		} else if params.DohMethod != "post" && params.DohMethod != "get" {
+			return nil, fmt.Errorf("invalid doh_method %s, expected post or get", params.DohMethod)
+		}
+	} else if params.DohMethod != "" {
+		return nil, errors.New("doh_method requires the https transport")
+	}
 
-		dnsType, ok := dnsTypeMap[strings.ToLower(params.Type)]
+	// fix parameters
+	params.Timeout = clampTimeout(params.Timeout)
+	params.rcode = dns.RcodeSuccess
+	if params.ExpectRcode != "" {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(params.ExpectRcode)]
 		if !ok {
-			return fmt.Errorf("invalid record type: %s", params.Type)
+			return nil, fmt.Errorf("invalid rcode: %s", params.ExpectRcode)
 		}
+		params.rcode = rcode
+	}
 
-		dnsServer := cfg.DNS.Server
-		if params.Server != "" {
-			dnsServer = params.Server
-		}
-		if !strings.Contains(dnsServer, ":") {
-			dnsServer += ":53"
-		}
+	return &params, nil
+}
 
-		client := dns.Client{}
-		msg := dns.Msg{}
-		msg.SetQuestion(dns.Fqdn(params.Name), dnsType)
+func (this dnsChecker) Run(ctx context.Context, p interface{}, result *CheckResult) error {
+	params := p.(*DnsCheckParams)
+	dnsType := dnsTypeMap[strings.ToLower(params.Type)]
+
+	msg := dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(params.Name), dnsType)
+	msg.SetEdns0(4096, false)
+
+	timeout := time.Duration(params.Timeout) * time.Second
+	var reply *dns.Msg
+	var rtt time.Duration
+	var err error
+	if params.Transport == "https" {
+		u, _ := url.Parse(params.Server)
+		reply, rtt, err = dnsExchangeHttps(ctx, &msg, params.Server, params.DohMethod, timeout, params.tlsConfig(u.Hostname()))
+	} else if params.Transport == "tls" {
+		server := withDefaultPort(params.Server, "853")
+		host, _, _ := net.SplitHostPort(server)
+		reply, rtt, err = dnsExchangeTls(ctx, &msg, server, timeout, params.tlsConfig(host))
+	} else {
+		reply, rtt, err = dnsExchange(ctx, &msg, dnsServerAddress(params.Server), params.Transport, timeout)
+	}
+	result.Duration = rtt
+	if err != nil {
+		return fmt.Errorf("query failed: %v", err)
+	}
+	result.Details = map[string]string{"rcode": dns.RcodeToString[reply.Rcode]}
+
+	if reply.Rcode != params.rcode {
+		return fmt.Errorf("query returned %s, expected %s", dns.RcodeToString[reply.Rcode], dns.RcodeToString[params.rcode])
+	} else if params.ExpectAuthoritative && !reply.Authoritative {
+		return errors.New("response is not authoritative")
+	} else if len(reply.Answer) == 0 && (params.ExpectRcode == "" || params.Expect != "" || len(params.ExpectValues) > 0) {
+		return fmt.Errorf("query returned no results")
+	}
 
-		reply, _, err := client.Exchange(&msg, dnsServer)
-		if err != nil {
-			return fmt.Errorf("query failed: %v", err)
-		} else if len(reply.Answer) == 0 {
-			return fmt.Errorf("query returned no results")
+	// records of the queried type, skipping e.g. CNAMEs leading to them
+	var values []string
+	for _, rr := range reply.Answer {
+		if rr.Header().Rrtype != dnsType {
+			continue
 		}
-
-		if params.Expect == "" {
-			return nil
+		values = append(values, dnsRecordValue(rr))
+		ttl := int(rr.Header().Ttl)
+		if params.MinTtl != nil && ttl < *params.MinTtl {
+			return fmt.Errorf("TTL %d of %s is less than minimum %d", ttl, dnsRecordValue(rr), *params.MinTtl)
+		} else if params.MaxTtl != nil && ttl > *params.MaxTtl {
+			return fmt.Errorf("TTL %d of %s exceeds maximum %d", ttl, dnsRecordValue(rr), *params.MaxTtl)
 		}
+	}
+	if len(values) > 0 {
+		result.Details["answer"] = snippet(strings.Join(values, ", "), 0)
+	}
 
-		for _, ans := range reply.Answer {
-			if strings.Contains(ans.String(), params.Expect) {
-				return nil
-			}
+	if len(params.ExpectValues) > 0 {
+		expected := dnsValueSet(dnsType, params.ExpectValues)
+		actual := dnsValueSet(dnsType, values)
+		if strings.Join(expected, "\x00") != strings.Join(actual, "\x00") {
+			return fmt.Errorf("record set mismatch, expected [%s] but got [%s]", strings.Join(expected, ", "), strings.Join(actual, ", "))
 		}
+	}
 
-		return fmt.Errorf("query answer does not contain expected string (answer is %s, expected %s)", reply.Answer[0].String(), params.Expect)
+	if params.Expect == "" {
+		return nil
+	}
+
+	for _, ans := range reply.Answer {
+		if strings.Contains(ans.String(), params.Expect) {
+			return nil
+		}
 	}
+
+	return fmt.Errorf("query answer does not contain expected string (answer is %s, expected %s)", reply.Answer[0].String(), params.Expect)
 }
@@ -1,42 +1,339 @@
 package gobearmon
 
-type HttpCheckParams struct {
+import "time"
+
+import "github.com/miekg/dns"
+
+// ResponseTimeParams can be embedded in check parameters to fail the check
+// when the response time exceeds max_response_time milliseconds.
+type ResponseTimeParams struct {
+	MaxResponseTime int `json:"max_response_time"`
+}
+
+func (this ResponseTimeParams) responseTimeLimit() time.Duration {
+	return time.Duration(this.MaxResponseTime) * time.Millisecond
+}
+
+// HttpClientParams configures the HTTP client of http and http_flow checks.
+type HttpClientParams struct {
+	TlsParams
+	Timeout int `json:"timeout"` // seconds per request
+	FollowRedirects *bool `json:"follow_redirects"` // default true
+	MaxRedirects int `json:"max_redirects"` // fail if more redirects are needed, default 10
+}
+
+// HttpRequestParams describes an HTTP request and the expected response.
+type HttpRequestParams struct {
+	MatchParams // applied to the response body
 	Url string `json:"url"`
 	Method string `json:"method"`
 	Body string `json:"body"`
 	Headers map[string]string `json:"headers"`
-	Timeout int `json:"timeout"`
-	Insecure bool `json:"insecure"`
 	Username string `json:"username"`
 	Password string `json:"password"`
 
 	ExpectStatus int `json:"expect_status"`
 	ExpectSubstring string `json:"expect_substring"`
+	ExpectJson []*JsonAssertion `json:"expect_json"` // assertions on a JSON response body
+	ExpectHeaders []*HeaderAssertion `json:"expect_headers"`
+	ExpectUrl string `json:"expect_url"` // URL of the final response, after redirects
+	ExpectLocation string `json:"expect_location"` // Location header of the final response, usually with follow_redirects=false
+}
+
+type HttpCheckParams struct {
+	ResponseTimeParams
+	HttpClientParams
+	HttpRequestParams
+}
+
+type HttpFlowCheckParams struct {
+	ResponseTimeParams
+	HttpClientParams
+	Steps []*HttpFlowStep `json:"steps"`
+}
+
+// HttpFlowStep is one request of an http_flow check. The url, body, headers,
+// username and password may reference variables extracted by earlier steps as
+// {{name}}.
+type HttpFlowStep struct {
+	HttpRequestParams
+	Name string `json:"name"`
+	Extract []*HttpExtraction `json:"extract"`
 }
 
 type TcpCheckParams struct {
+	ResponseTimeParams
+	MatchParams // applied to the response line
+	TlsParams
 	Address string `json:"address"`
 	Timeout int `json:"timeout"`
 	Payload string `json:"payload"`
 	ForceIP int `json:"force_ip"`
+	Tls bool `json:"tls"` // perform a TLS handshake immediately after connecting
+	StartTls string `json:"starttls"` // upgrade to TLS with STARTTLS: smtp, imap, pop3, ftp, xmpp, xmpp-server, ldap or postgres
+	Script []*TcpStep `json:"script"` // dialog to perform instead of payload/expect
 
 	Expect string `json:"expect"`
 }
 
+// TcpStep is one exchange of a scripted tcp check: it sends data, if any, and
+// then reads and verifies a response if any read or expect option is set.
+// Responses are read up to a newline unless read_until or read_bytes is set.
+type TcpStep struct {
+	MatchParams // applied to the response
+	Send string `json:"send"` // sent as-is, without appending a newline
+	SendHex string `json:"send_hex"`
+	ReadUntil string `json:"read_until"` // delimiter, included in the response
+	ReadUntilHex string `json:"read_until_hex"`
+	ReadBytes int `json:"read_bytes"` // read exactly this many bytes
+	Timeout int `json:"timeout"` // seconds, defaults to the check timeout
+
+	Expect string `json:"expect"`
+	ExpectHex string `json:"expect_hex"`
+
+	send []byte
+	readUntil []byte
+	expect []byte
+}
+
+type SmtpCheckParams struct {
+	ResponseTimeParams
+	TlsParams
+	Address string `json:"address"`
+	Timeout int `json:"timeout"`
+	Tls bool `json:"tls"` // implicit TLS, e.g. port 465
+	StartTls bool `json:"starttls"` // require upgrading with STARTTLS
+	Helo string `json:"helo"` // EHLO name, default gobearmon
+	Username string `json:"username"` // authenticate if set; requires tls or starttls
+	Password string `json:"password"`
+	AuthMechanism string `json:"auth_mechanism"` // plain (default) or login
+
+	ExpectBanner string `json:"expect_banner"` // substring of the 220 banner
+	ExpectExtensions []string `json:"expect_extensions"` // e.g. SIZE, PIPELINING, 8BITMIME
+}
+
+// MailRoundtripCheckParams configures the mail_roundtrip check, which sends a
+// message through the SMTP server and waits for it to arrive in the IMAP
+// mailbox. The TLS options apply to both servers.
+type MailRoundtripCheckParams struct {
+	ResponseTimeParams
+	TlsParams
+	Timeout int `json:"timeout"` // seconds per connection
+	From string `json:"from"`
+	To string `json:"to"`
+	PlaintextAuth bool `json:"plaintext_auth"` // allow credentials without TLS, e.g. for local test servers
+
+	SmtpAddress string `json:"smtp_address"`
+	SmtpTls bool `json:"smtp_tls"`
+	SmtpStartTls bool `json:"smtp_starttls"`
+	SmtpUsername string `json:"smtp_username"` // authenticate with AUTH PLAIN if set
+	SmtpPassword string `json:"smtp_password"`
+
+	ImapAddress string `json:"imap_address"`
+	ImapTls bool `json:"imap_tls"`
+	ImapStartTls bool `json:"imap_starttls"`
+	ImapUsername string `json:"imap_username"`
+	ImapPassword string `json:"imap_password"`
+	Mailbox string `json:"mailbox"` // default INBOX
+
+	MaxDelay int `json:"max_delay"` // seconds until the message must arrive, default 30
+	PollInterval int `json:"poll_interval"` // seconds between IMAP searches, default 5
+}
+
+// UdpCheckParams configures the udp check, which sends a datagram and waits
+// for a response, resending up to Retries times if none arrives.
+type UdpCheckParams struct {
+	ResponseTimeParams
+	MatchParams // applied to the response
+	Address string `json:"address"`
+	ForceIP int `json:"force_ip"`
+	Timeout int `json:"timeout"` // seconds to wait for a response to each datagram
+	Retries int `json:"retries"` // additional datagrams to send if no response arrives, default 0
+	Payload string `json:"payload"`
+	PayloadHex string `json:"payload_hex"` // binary payload, instead of payload
+	Expect string `json:"expect"` // substring of the response
+	ExpectHex string `json:"expect_hex"`
+
+	payload []byte
+	expect []byte
+}
+
+type NtpCheckParams struct {
+	ResponseTimeParams
+	Address string `json:"address"` // host or host:port
+	ForceIP int `json:"force_ip"`
+	Timeout int `json:"timeout"`
+	MaxStratum int `json:"max_stratum"` // default 15, i.e. any synchronised server
+	MaxOffset int `json:"max_offset"` // milliseconds, relative to the worker's clock
+}
+
+// DnsZoneCheckParams configures the dns_zone check, which compares the SOA
+// serial, and optionally other records, across all nameservers of a zone.
+type DnsZoneCheckParams struct {
+	ResponseTimeParams
+	Zone string `json:"zone"`
+	Server string `json:"server"` // resolver used to find the nameservers and their addresses; form is address:port
+	Nameservers []string `json:"nameservers"` // names or IP addresses to query instead of the zone's NS records
+	ForceIP int `json:"force_ip"` // only query IPv4 or IPv6 addresses of the nameservers
+	Transport string `json:"transport"`
+	Timeout int `json:"timeout"` // seconds per query
+	Records []*DnsZoneRecord `json:"records"`
+}
+
+// DnsZoneRecord is a record set that must be identical on every nameserver.
+type DnsZoneRecord struct {
+	Name string `json:"name"` // relative to the zone, or absolute with a trailing dot; default is the zone apex
+	Type string `json:"type"`
+
+	fqdn string
+	rrtype uint16
+}
+
+// DnssecCheckParams configures the dnssec check, which validates the chain of
+// signatures from the trust anchor down to the queried record set.
+type DnssecCheckParams struct {
+	ResponseTimeParams
+	Server string `json:"server"` // resolver, which must return DNSSEC records; form is address:port
+	Name string `json:"name"`
+	Type string `json:"type"` // e.g. A or SOA
+	Transport string `json:"transport"`
+	Timeout int `json:"timeout"` // seconds per query
+	TrustAnchor []string `json:"trust_anchor"` // DS or DNSKEY records of one zone; default is the root zone
+	Days int `json:"days"` // fail when a signature in the chain expires within this many days
+
+	anchor []dns.RR
+}
+
+// ValueParams verifies a single value returned by a database check.
+type ValueParams struct {
+	Expect *string `json:"expect"` // exact value
+	MinValue *float64 `json:"min_value"` // value must be numeric and at least this
+	MaxValue *float64 `json:"max_value"`
+}
+
+// SqlCheckParams configures the mysql and postgres checks, which run a query
+// and verify the first column of the first row, or the named field.
+type SqlCheckParams struct {
+	ResponseTimeParams
+	TlsParams
+	ValueParams
+	Address string `json:"address"` // host or host:port
+	Timeout int `json:"timeout"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Database string `json:"database"`
+	Query string `json:"query"` // default SELECT 1
+	Field string `json:"field"` // column to verify instead of the first
+	TlsMode string `json:"tls_mode"` // disable (default), require or verify
+}
+
+// RedisCheckParams configures the redis check, which runs a command and
+// verifies the reply, or a field of the INFO output.
+type RedisCheckParams struct {
+	ResponseTimeParams
+	TlsParams
+	ValueParams
+	Address string `json:"address"` // host or host:port
+	Timeout int `json:"timeout"`
+	Username string `json:"username"` // ACL user, requires password
+	Password string `json:"password"`
+	Database int `json:"database"`
+	Command []string `json:"command"` // default PING
+	Field string `json:"field"` // e.g. role or connected_slaves when the command is INFO
+	TlsMode string `json:"tls_mode"` // disable (default), require or verify
+}
+
 type IcmpCheckParams struct {
+	ResponseTimeParams
 	Target string `json:"target"`
-	PacketLoss bool `json:"packetloss"`
+	PacketLoss bool `json:"packetloss"` // legacy, same as max_packet_loss=30
 	ForceIP int `json:"force_ip"`
+	Count int `json:"count"` // number of echo requests, default 5
+	Interval int `json:"interval"` // milliseconds between echo requests, default 1000
+	Timeout int `json:"timeout"` // seconds to wait for replies after the last request, default 2
+
+	MaxPacketLoss *int `json:"max_packet_loss"` // percent; by default only 100% loss fails
+	MaxRtt int `json:"max_rtt"` // milliseconds, compared against the slowest reply
+	MaxJitter int `json:"max_jitter"` // milliseconds
 }
 
+// SslExpireCheckParams configures the ssl_expire check. By default only the
+// expiration of the server certificate is checked; server_name sets the SNI
+// name, and ca_bundle replaces the system roots when verify is set.
 type SslExpireCheckParams struct {
+	ResponseTimeParams
+	TlsParams
 	Address string `json:"address"`
 	Days int `json:"days"`
+	Verify bool `json:"verify"` // verify the served chain against the trust store
+	VerifyHostname bool `json:"verify_hostname"` // verify that the certificate matches server_name, or the host in address
+	CheckChain bool `json:"check_chain"` // apply days to every certificate in the served chain
+	Ocsp bool `json:"ocsp"` // fail if the certificate is revoked, using the stapled OCSP response or else the responder
+	RequireOcspStaple bool `json:"require_ocsp_staple"`
+	StartTls string `json:"starttls"` // upgrade to TLS with STARTTLS: smtp, imap, pop3, ftp, xmpp, xmpp-server, ldap or postgres
+}
+
+// DomainExpireCheckParams configures the domain_expire check, which looks up
+// the registration of a domain with RDAP.
+type DomainExpireCheckParams struct {
+	ResponseTimeParams
+	Domain string `json:"domain"`
+	Days int `json:"days"` // fail when the registration expires within this many days
+	Timeout int `json:"timeout"`
+	BootstrapUrl string `json:"bootstrap_url"` // IANA bootstrap registry used to find the RDAP server, default https://data.iana.org/rdap/dns.json
+	Server string `json:"server"` // RDAP base URL to query instead of the bootstrap result, e.g. https://rdap.example.net/
+	ForbiddenStatuses []string `json:"forbidden_statuses"` // default client hold, server hold, redemption period and pending delete
+}
+
+// TlsPolicyCheckParams configures the tls_policy check, which probes the
+// protocol versions and cipher suites that the server accepts. Each option is
+// a rule, and every violated rule is reported.
+type TlsPolicyCheckParams struct {
+	ResponseTimeParams
+	Address string `json:"address"`
+	ServerName string `json:"server_name"` // SNI name
+	StartTls string `json:"starttls"` // upgrade to TLS with STARTTLS, as in the tcp check
+	Timeout int `json:"timeout"` // seconds per handshake
+
+	MinVersion string `json:"min_version"` // e.g. 1.2; older versions must be rejected
+	RequireVersions []string `json:"require_versions"` // versions that must be accepted, e.g. ["1.3"]
+	AllowedCiphers []string `json:"allowed_ciphers"` // if set, TLS 1.0-1.2 cipher suites other than these must be rejected
+	ForbiddenCiphers []string `json:"forbidden_ciphers"` // substrings of cipher suite names that must be rejected, e.g. CBC or TLS_RSA_
+	RejectInsecureCiphers bool `json:"reject_insecure_ciphers"` // suites with known weaknesses, e.g. RC4 and 3DES, must be rejected
+	MinRsaKeySize int `json:"min_rsa_key_size"` // bits, e.g. 2048
+	MinEcdsaKeySize int `json:"min_ecdsa_key_size"` // bits, e.g. 256
+	ForbiddenSignatureAlgorithms []string `json:"forbidden_signature_algorithms"` // e.g. SHA1-RSA, applied to every served certificate
+
+	minVersion uint16
+	requireVersions []uint16
 }
 
 type DnsCheckParams struct {
-	Server string `json:"server"` // optionally force to use this DNS server; form is address:port
+	ResponseTimeParams
+	TlsParams // for the tls and https transports
+	Server string `json:"server"` // optionally force to use this DNS server; form is address:port, or a URL for https
 	Name string `json:"name"` // name to query
 	Type string `json:"type"` // DNS record type, e.g. A or CNAME
 	Expect string `json:"expect"` // expected response
+	Transport string `json:"transport"` // udp (default, retrying truncated responses over tcp), tcp, tls (DNS-over-TLS) or https (DNS-over-HTTPS)
+	DohMethod string `json:"doh_method"` // post (default) or get
+	Timeout int `json:"timeout"`
+
+	// by default the response must be NOERROR with at least one answer; if
+	// expect_rcode is set, empty answers are allowed unless values are expected
+	ExpectRcode string `json:"expect_rcode"` // e.g. NOERROR or NXDOMAIN
+	ExpectValues []string `json:"expect_values"` // exact set of record values of the queried type, e.g. ["192.0.2.1","192.0.2.2"]
+	MinTtl *int `json:"min_ttl"` // seconds, applied to every record of the queried type
+	MaxTtl *int `json:"max_ttl"`
+	ExpectAuthoritative bool `json:"expect_authoritative"` // require the AA flag
+
+	rcode int
+}
+
+type HeartbeatCheckParams struct {
+	Token string `json:"token"` // secret in the ping URL, at least 16 letters, digits, - or _
+	Grace *int `json:"grace"` // seconds added to the check interval before a missing ping fails the check, default 60
+	MaxRuntime int `json:"max_runtime"` // if set, seconds after a start ping within which the job must report success or failure
+
+	grace time.Duration
 }
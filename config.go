@@ -13,6 +13,7 @@ type ControllerConfig struct {
 	Addr string
 	Database []string
 	Confirmations int
+	HeartbeatAddr string
 }
 
 type WorkerConfig struct {
@@ -16,19 +16,32 @@ type Controller struct {
 	Addr string
 	Databases []*sql.DB
 	Confirmations int
+	HeartbeatAddr string // if set, listen address of the HTTP endpoint pinged by heartbeat checks
 	mu sync.Mutex
 	checks map[CheckId]*Check
+	heartbeats map[CheckId]*heartbeatState
 	reloadErrorCount int
+	invalidChecks map[CheckId]string
 }
 
 func (this *Controller) Start() {
 	this.checks = make(map[CheckId]*Check)
+	this.invalidChecks = make(map[CheckId]string)
+	this.heartbeats = make(map[CheckId]*heartbeatState)
 
 	ln, err := net.Listen("tcp", this.Addr)
 	if err != nil {
 		panic(err)
 	}
 
+	if this.HeartbeatAddr != "" {
+		heartbeatLn, err := net.Listen("tcp", this.HeartbeatAddr)
+		if err != nil {
+			panic(err)
+		}
+		go this.serveHeartbeats(heartbeatLn)
+	}
+
 	go func() {
 		for {
 			conn, err := ln.Accept()
@@ -49,10 +62,25 @@ func (this *Controller) Start() {
 	}()
 }
 
+// GetCheck returns a copy of the check definition, so that a reload changing
+// the check while it runs does not mix its old type with new parameters.
 func (this *Controller) GetCheck(checkId CheckId) *Check {
 	this.mu.Lock()
 	defer this.mu.Unlock()
-	return this.checks[checkId]
+	check := this.checks[checkId]
+	if check == nil {
+		return nil
+	}
+	return &Check{
+		Id: check.Id,
+		Name: check.Name,
+		Type: check.Type,
+		Data: check.Data,
+		Params: check.Params,
+		Interval: check.Interval,
+		Delay: check.Delay,
+		Status: check.Status,
+	}
 }
 
 func (this *Controller) randomDB() *sql.DB {
@@ -114,26 +142,17 @@ func (this *Controller) request(requestor string, request *ControllerRequest) *C
 			continue
 		}
 
-		if checkResult.Status != check.Status {
-			check.TurnSet[requestor] = true
-			if len(check.TurnSet) >= this.Confirmations {
-				for id := range check.TurnSet {
-					delete(check.TurnSet, id)
-				}
-				check.TurnCount++
-				debugPrintf("check [%s]: turn count incremented to %d/%d", check.Name, check.TurnCount, check.Delay + 1)
-				if check.TurnCount > check.Delay {
-					check.Status = checkResult.Status
-					check.LastStatusChange = time.Now()
-					log.Printf("status of check %s changed to %s", check.Name, check.Status)
-					go this.reportAndUpdate(check, checkResult)
-				}
-			}
-		} else {
-			check.TurnCount = 0
-			for id := range check.TurnSet {
-				delete(check.TurnSet, id)
-			}
+		this.updateStatus(check, requestor, checkResult, this.Confirmations, check.Delay)
+	}
+
+	// heartbeat checks are not performed by workers; instead we evaluate the
+	//  pings received so far, with the grace period taking the role of delay
+	now := time.Now()
+	for _, check := range this.checks {
+		if params, ok := check.Params.(*HeartbeatCheckParams); ok {
+			check.LastTime = now
+			check.LastWorker = heartbeatRequestor
+			this.updateStatus(check, heartbeatRequestor, this.heartbeatResult(check, params, now), 1, 0)
 		}
 	}
 
@@ -141,7 +160,7 @@ func (this *Controller) request(requestor string, request *ControllerRequest) *C
 	for checkId, check := range this.checks {
 		if len(response.Checks) >= request.Count {
 			break
-		} else if check.Lock != "" {
+		} else if check.Lock != "" || isHeartbeatCheck(check) {
 			continue
 		}
 
@@ -165,6 +184,33 @@ func (this *Controller) request(requestor string, request *ControllerRequest) *C
 	return &response
 }
 
+// updateStatus counts a result towards changing the check status, which
+//  changes once enough requestors agree for more than delay turns. The lock
+//  must be held.
+func (this *Controller) updateStatus(check *Check, requestor string, checkResult *CheckResult, confirmations int, delay int) {
+	if checkResult.Status != check.Status {
+		check.TurnSet[requestor] = true
+		if len(check.TurnSet) >= confirmations {
+			for id := range check.TurnSet {
+				delete(check.TurnSet, id)
+			}
+			check.TurnCount++
+			debugPrintf("check [%s]: turn count incremented to %d/%d", check.Name, check.TurnCount, delay + 1)
+			if check.TurnCount > delay {
+				check.Status = checkResult.Status
+				check.LastStatusChange = time.Now()
+				log.Printf("status of check %s changed to %s", check.Name, check.Status)
+				go this.reportAndUpdate(check, checkResult)
+			}
+		}
+	} else {
+		check.TurnCount = 0
+		for id := range check.TurnSet {
+			delete(check.TurnSet, id)
+		}
+	}
+}
+
 func (this *Controller) reportAndUpdate(check *Check, result *CheckResult) {
 	// attempt reporting
 	// if we succeed, then update the database
@@ -270,6 +316,8 @@ func (this *Controller) reload() {
 
 	var dbChecks []*Check
 	existCheckIds := make(map[CheckId]bool)
+	invalidChecks := make(map[CheckId]string)
+	var invalidReports []string
 
 	for rows.Next() {
 		check := MakeCheck()
@@ -281,13 +329,44 @@ func (this *Controller) reload() {
 			this.incrementReloadError()
 			return
 		}
+
+		// invalid checks are not scheduled; we notify the admin the first
+		//  time we see each invalid definition
+		check.Params, err = ParseCheck(check.Type, check.Data)
+		if err != nil {
+			key := check.Type + "\x00" + check.Data
+			invalidChecks[check.Id] = key
+			if this.invalidChecks[check.Id] != key {
+				log.Printf("controller: check %d (%s) is invalid: %s", check.Id, check.Name, err.Error())
+				invalidReports = append(invalidReports, fmt.Sprintf("ID: %d\nName: %s\nType: %s\nData: %s\nError: %s", check.Id, check.Name, check.Type, check.Data, err.Error()))
+			}
+			continue
+		}
+
 		existCheckIds[check.Id] = true
 		dbChecks = append(dbChecks, check)
 	}
 
+	if len(invalidReports) > 0 {
+		go mailAdmin("gobearmon: invalid check definitions", fmt.Sprintf("The following checks are invalid and will not be performed until fixed:\n\n%s\n\ngobearmon", strings.Join(invalidReports, "\n\n")))
+	}
+
+	// pings may have been received by other controllers
+	var storedHeartbeats map[CheckId]*heartbeatState
+	for _, check := range dbChecks {
+		if isHeartbeatCheck(check) {
+			storedHeartbeats, err = loadHeartbeats(db)
+			if err != nil {
+				log.Printf("controller: error loading heartbeats: %s", err.Error())
+			}
+			break
+		}
+	}
+
 	this.mu.Lock()
 	defer this.mu.Unlock()
 	this.reloadErrorCount = 0
+	this.invalidChecks = invalidChecks
 
 	// insert/update
 	for _, dbCheck := range dbChecks {
@@ -298,6 +377,7 @@ func (this *Controller) reload() {
 			check.Name = dbCheck.Name
 			check.Type = dbCheck.Type
 			check.Data = dbCheck.Data
+			check.Params = dbCheck.Params
 			check.Interval = dbCheck.Interval
 			check.Delay = dbCheck.Delay
 
@@ -316,4 +396,6 @@ func (this *Controller) reload() {
 			check.Lock = ""
 		}
 	}
+
+	this.mergeHeartbeats(storedHeartbeats, time.Now())
 }
@@ -0,0 +1,230 @@
+package gobearmon
+
+import "context"
+import "crypto/tls"
+import "database/sql"
+import "errors"
+import "fmt"
+import "net"
+import "strconv"
+import "strings"
+import "time"
+
+import "github.com/go-sql-driver/mysql"
+import "github.com/lib/pq"
+
+// check validates a value returned by a database against the expectations.
+func (this *ValueParams) check(value string, isNull bool) error {
+	display := value
+	if isNull {
+		display = "NULL"
+	}
+
+	if this.Expect != nil && (isNull || value != *this.Expect) {
+		return fmt.Errorf("value mismatch, expected [%s] but got [%s]", *this.Expect, display)
+	}
+	if this.MinValue == nil && this.MaxValue == nil {
+		return nil
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if isNull || err != nil {
+		return fmt.Errorf("value [%s] is not numeric", display)
+	} else if this.MinValue != nil && number < *this.MinValue {
+		return fmt.Errorf("value %v is less than minimum %v", number, *this.MinValue)
+	} else if this.MaxValue != nil && number > *this.MaxValue {
+		return fmt.Errorf("value %v exceeds maximum %v", number, *this.MaxValue)
+	}
+	return nil
+}
+
+func (this *ValueParams) active() bool {
+	return this.Expect != nil || this.MinValue != nil || this.MaxValue != nil
+}
+
+func validateTlsMode(mode string) error {
+	if mode != "" && mode != "disable" && mode != "require" && mode != "verify" {
+		return fmt.Errorf("invalid tls_mode %s, expected disable, require or verify", mode)
+	}
+	return nil
+}
+
+type sqlChecker struct {
+	driver string // mysql or postgres
+	defaultPort string
+}
+
+func (this sqlChecker) Describe() string {
+	return fmt.Sprintf("%s query, optionally verifying the returned value", this.driver)
+}
+
+func (this sqlChecker) Parse(data string) (interface{}, error) {
+	var params SqlCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	params.Address = withDefaultPort(params.Address, this.defaultPort)
+	if err := validateAddress(params.Address); err != nil {
+		return nil, err
+	} else if params.Username == "" {
+		return nil, errors.New("username is required")
+	} else if err := validateTlsMode(params.TlsMode); err != nil {
+		return nil, err
+	} else if err := params.loadTls(); err != nil {
+		return nil, err
+	}
+	if this.driver == "postgres" && params.ServerName != "" {
+		host, _, _ := net.SplitHostPort(params.Address)
+		if net.ParseIP(host) == nil {
+			return nil, errors.New("server_name requires an IP address in address for postgres checks")
+		}
+	}
+
+	// fix parameters
+	params.Timeout = clampTimeout(params.Timeout)
+	if params.TlsMode == "verify" && params.Insecure {
+		params.TlsMode = "require"
+	}
+	if params.Query == "" {
+		params.Query = "SELECT 1"
+	}
+	return &params, nil
+}
+
+func (this sqlChecker) Run(ctx context.Context, p interface{}, result *CheckResult) error {
+	params := p.(*SqlCheckParams)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(params.Timeout) * time.Second)
+	defer cancel()
+
+	var db *sql.DB
+	var err error
+	if this.driver == "mysql" {
+		db, err = this.openMysql(params)
+	} else {
+		db, err = this.openPostgres(params)
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	rows, err := db.QueryContext(ctx, params.Query)
+	if err != nil {
+		return fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("query failed: %v", err)
+		} else if params.active() {
+			return errors.New("query returned no rows")
+		}
+		return nil
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("query failed: %v", err)
+	}
+	values := make([]sql.RawBytes, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := rows.Scan(pointers...); err != nil {
+		return fmt.Errorf("failed to read query result: %v", err)
+	}
+
+	idx := 0
+	if params.Field != "" {
+		idx = -1
+		for i, column := range columns {
+			if strings.EqualFold(column, params.Field) {
+				idx = i
+			}
+		}
+		if idx == -1 {
+			return fmt.Errorf("query result has no column %s", params.Field)
+		}
+	}
+	if len(values) == 0 {
+		return errors.New("query returned no columns")
+	}
+	result.Details = map[string]string{"value": string(values[idx])}
+	return params.check(string(values[idx]), values[idx] == nil)
+}
+
+func (this sqlChecker) openMysql(params *SqlCheckParams) (*sql.DB, error) {
+	config := mysql.NewConfig()
+	config.User = params.Username
+	config.Passwd = params.Password
+	config.Net = "tcp"
+	config.Addr = params.Address
+	config.DBName = params.Database
+	config.Timeout = time.Duration(params.Timeout) * time.Second
+	host, _, _ := net.SplitHostPort(params.Address)
+	if params.TlsMode == "require" {
+		config.TLS = &tls.Config{InsecureSkipVerify: true}
+	} else if params.TlsMode == "verify" {
+		config.TLS = params.tlsConfig(host)
+	}
+	connector, err := mysql.NewConnector(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection configuration: %v", err)
+	}
+	return sql.OpenDB(connector), nil
+}
+
+func (this sqlChecker) openPostgres(params *SqlCheckParams) (*sql.DB, error) {
+	host, port, _ := net.SplitHostPort(params.Address)
+	options := map[string]string{
+		"host": host,
+		"port": port,
+		"user": params.Username,
+		"password": params.Password,
+		"dbname": params.Database,
+		"connect_timeout": strconv.Itoa(params.Timeout),
+		"sslmode": "disable",
+	}
+	if params.Database == "" {
+		options["dbname"] = "postgres"
+	}
+	if params.TlsMode == "require" {
+		options["sslmode"] = "require"
+	} else if params.TlsMode == "verify" {
+		options["sslmode"] = "verify-full"
+		if params.ServerName != "" {
+			options["host"] = params.ServerName
+			options["hostaddr"] = host
+		}
+
+		// the driver only accepts PEM data for all options or none
+		options["sslinline"] = "true"
+		for option, value := range map[string]string{"sslrootcert": params.CaBundle, "sslcert": params.ClientCert, "sslkey": params.ClientKey} {
+			if value == "" {
+				continue
+			}
+			bytes, err := readPEM(value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %v", option, err)
+			}
+			options[option] = string(bytes)
+		}
+	}
+
+	var parts []string
+	for k, v := range options {
+		v = strings.Replace(v, "\\", "\\\\", -1)
+		v = strings.Replace(v, "'", "\\'", -1)
+		parts = append(parts, fmt.Sprintf("%s='%s'", k, v))
+	}
+	connector, err := pq.NewConnector(strings.Join(parts, " "))
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection options: %v", err)
+	}
+	return sql.OpenDB(connector), nil
+}
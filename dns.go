@@ -0,0 +1,153 @@
+package gobearmon
+
+import "bytes"
+import "context"
+import "crypto/tls"
+import "encoding/base64"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net"
+import "net/http"
+import "sort"
+import "strings"
+import "time"
+
+import "github.com/miekg/dns"
+
+func validateDnsTransport(transport string) error {
+	if transport != "" && transport != "udp" && transport != "tcp" {
+		return fmt.Errorf("invalid transport %s, expected udp or tcp", transport)
+	}
+	return nil
+}
+
+// dnsServerAddress returns the server to query, defaulting to the configured
+// server and port 53.
+func dnsServerAddress(server string) string {
+	if server == "" {
+		server = cfg.DNS.Server
+	}
+	return withDefaultPort(server, "53")
+}
+
+// dnsExchange sends the query with the given transport; truncated UDP
+// responses are retried over TCP. The returned duration covers all attempts.
+func dnsExchange(ctx context.Context, msg *dns.Msg, server string, transport string, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	if transport == "" {
+		transport = "udp"
+	}
+	client := dns.Client{Net: transport, Timeout: timeout}
+	reply, rtt, err := client.ExchangeContext(ctx, msg, server)
+	if err == nil && reply.Truncated && transport == "udp" {
+		var tcpRtt time.Duration
+		client.Net = "tcp"
+		reply, tcpRtt, err = client.ExchangeContext(ctx, msg, server)
+		rtt += tcpRtt
+	}
+	return reply, rtt, err
+}
+
+// dnsExchangeTls sends the query over DNS-over-TLS (RFC 7858).
+func dnsExchangeTls(ctx context.Context, msg *dns.Msg, server string, timeout time.Duration, tlsConfig *tls.Config) (*dns.Msg, time.Duration, error) {
+	client := dns.Client{Net: "tcp-tls", Timeout: timeout, TLSConfig: tlsConfig}
+	return client.ExchangeContext(ctx, msg, server)
+}
+
+// dnsExchangeHttps sends the query over DNS-over-HTTPS (RFC 8484), with the
+// GET or POST method.
+func dnsExchangeHttps(ctx context.Context, msg *dns.Msg, url string, method string, timeout time.Duration, tlsConfig *tls.Config) (*dns.Msg, time.Duration, error) {
+	// the ID should be zero to improve caching, see RFC 8484 section 4.1
+	query := msg.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var request *http.Request
+	if method == "get" {
+		separator := "?"
+		if strings.Contains(url, "?") {
+			separator = "&"
+		}
+		request, err = http.NewRequestWithContext(ctx, "GET", url + separator + "dns=" + base64.RawURLEncoding.EncodeToString(packed), nil)
+	} else {
+		request, err = http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(packed))
+		if err == nil {
+			request.Header.Set("Content-Type", "application/dns-message")
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	request.Header.Set("Accept", "application/dns-message")
+
+	client := http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	defer client.CloseIdleConnections()
+	start := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 65536))
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, rtt, err
+	} else if response.StatusCode != 200 {
+		return nil, rtt, fmt.Errorf("server returned HTTP status %d", response.StatusCode)
+	} else if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/dns-message") {
+		return nil, rtt, fmt.Errorf("server returned unexpected content type %s", contentType)
+	}
+
+	reply := new(dns.Msg)
+	if err := reply.Unpack(body); err != nil {
+		return nil, rtt, fmt.Errorf("invalid response: %v", err)
+	}
+	reply.Id = msg.Id
+	return reply, rtt, nil
+}
+
+// dnsRecordValue returns the data of a record in presentation format, or the
+// unquoted concatenated strings for TXT records.
+func dnsRecordValue(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.TXT:
+		return strings.Join(rr.Txt, "")
+	case *dns.SPF:
+		return strings.Join(rr.Txt, "")
+	}
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// normalizeDnsValue makes record values comparable regardless of case, a
+// trailing dot on names, or IPv6 formatting. TXT values are compared as is.
+func normalizeDnsValue(rrtype uint16, value string) string {
+	if rrtype == dns.TypeTXT || rrtype == dns.TypeSPF {
+		return value
+	}
+	value = strings.TrimSpace(value)
+	if ip := net.ParseIP(value); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(strings.TrimSuffix(value, "."))
+}
+
+// dnsValueSet returns the sorted, normalized, de-duplicated values.
+func dnsValueSet(rrtype uint16, values []string) []string {
+	seen := make(map[string]bool)
+	var set []string
+	for _, value := range values {
+		value = normalizeDnsValue(rrtype, value)
+		if !seen[value] {
+			seen[value] = true
+			set = append(set, value)
+		}
+	}
+	sort.Strings(set)
+	return set
+}
@@ -0,0 +1,362 @@
+package gobearmon
+
+import "context"
+import "errors"
+import "fmt"
+import "net"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+import "github.com/miekg/dns"
+
+// maximum number of record sets compared by a dns_zone check
+const maxDnsZoneRecords = 10
+
+// dnsZoneServer is a single address of a nameserver and what it returned.
+type dnsZoneServer struct {
+	Name string
+	Address string // host:port
+	Serial uint32
+	Records []string // normalized values of each record set, joined for comparison
+	Err error
+}
+
+func (this *dnsZoneServer) String() string {
+	host, _, _ := net.SplitHostPort(this.Address)
+	if this.Name == this.Address {
+		return this.Address
+	} else if this.Name == "" || this.Name == host {
+		return host
+	}
+	return fmt.Sprintf("%s (%s)", this.Name, host)
+}
+
+// prepare validates the record and resolves its name relative to the zone.
+func (this *DnsZoneRecord) prepare(zone string) error {
+	var ok bool
+	this.rrtype, ok = dnsTypeMap[strings.ToLower(this.Type)]
+	if !ok {
+		return fmt.Errorf("invalid record type: %s", this.Type)
+	}
+	if this.Name == "" || this.Name == "@" {
+		this.fqdn = zone
+	} else if strings.HasSuffix(this.Name, ".") {
+		this.fqdn = strings.ToLower(this.Name)
+	} else {
+		this.fqdn = strings.ToLower(this.Name) + "." + zone
+	}
+	if _, ok := dns.IsDomainName(this.fqdn); !ok {
+		return fmt.Errorf("invalid name: %s", this.Name)
+	}
+	return nil
+}
+
+type dnsZoneChecker struct{}
+
+func (this dnsZoneChecker) Describe() string {
+	return "DNS zone consistency across all authoritative nameservers"
+}
+
+func (this dnsZoneChecker) Parse(data string) (interface{}, error) {
+	var params DnsZoneCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Zone == "" {
+		return nil, errors.New("zone is required")
+	} else if _, ok := dns.IsDomainName(params.Zone); !ok {
+		return nil, fmt.Errorf("invalid zone: %s", params.Zone)
+	} else if err := validateForceIP(params.ForceIP); err != nil {
+		return nil, err
+	} else if err := validateDnsTransport(params.Transport); err != nil {
+		return nil, err
+	} else if len(params.Records) > maxDnsZoneRecords {
+		return nil, fmt.Errorf("at most %d records are allowed", maxDnsZoneRecords)
+	}
+	params.Zone = dns.Fqdn(strings.ToLower(params.Zone))
+	for i, record := range params.Records {
+		if record == nil {
+			return nil, fmt.Errorf("record %d is null", i + 1)
+		} else if err := record.prepare(params.Zone); err != nil {
+			return nil, fmt.Errorf("record %d: %v", i + 1, err)
+		}
+	}
+
+	// fix parameters
+	params.Timeout = clampTimeout(params.Timeout)
+	// nameserver discovery, address lookups in parallel, then the SOA and
+	// records on every server in parallel
+	total := (3 + len(params.Records)) * params.Timeout
+	if time.Duration(total) * time.Second > checkTimeout {
+		return nil, fmt.Errorf("check may take up to %d seconds, reduce the number of records or the timeout", total)
+	}
+	return &params, nil
+}
+
+func (this dnsZoneChecker) Run(ctx context.Context, p interface{}, result *CheckResult) error {
+	params := p.(*DnsZoneCheckParams)
+	resolver := dnsServerAddress(params.Server)
+
+	names := params.Nameservers
+	if len(names) == 0 {
+		var err error
+		names, err = this.lookup(ctx, params, resolver, params.Zone, dns.TypeNS)
+		if err != nil {
+			return fmt.Errorf("failed to find nameservers: %v", err)
+		} else if len(names) == 0 {
+			return fmt.Errorf("zone %s has no NS records", params.Zone)
+		}
+	}
+
+	// resolve every nameserver to its addresses, all lookups in parallel so
+	//  that they take a single timeout
+	type addressLookup struct {
+		name string
+		rrtype uint16
+		values []string
+		err error
+	}
+	var servers []*dnsZoneServer
+	var problems []string
+	var lookups [][]*addressLookup // by nameserver, nil for literal addresses
+	var wg sync.WaitGroup
+	for _, name := range names {
+		if _, _, err := net.SplitHostPort(name); err == nil {
+			servers = append(servers, &dnsZoneServer{Name: name, Address: name})
+			continue
+		} else if ip := net.ParseIP(name); ip != nil {
+			servers = append(servers, &dnsZoneServer{Name: name, Address: net.JoinHostPort(name, "53")})
+			continue
+		}
+
+		var nameLookups []*addressLookup
+		for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if rrtype == dns.TypeA && params.ForceIP == 6 || rrtype == dns.TypeAAAA && params.ForceIP == 4 {
+				continue
+			}
+			lookup := &addressLookup{name: name, rrtype: rrtype}
+			nameLookups = append(nameLookups, lookup)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				lookup.values, lookup.err = this.lookup(ctx, params, resolver, dns.Fqdn(lookup.name), lookup.rrtype)
+			}()
+		}
+		lookups = append(lookups, nameLookups)
+	}
+	wg.Wait()
+
+	for _, nameLookups := range lookups {
+		var addresses []string
+		name := nameLookups[0].name
+		for _, lookup := range nameLookups {
+			if lookup.err != nil {
+				problems = append(problems, fmt.Sprintf("%s: address lookup failed: %v", name, lookup.err))
+			}
+			addresses = append(addresses, lookup.values...)
+		}
+		if len(addresses) == 0 {
+			problems = append(problems, fmt.Sprintf("%s: no addresses found", name))
+		}
+		for _, address := range addresses {
+			servers = append(servers, &dnsZoneServer{Name: strings.TrimSuffix(name, "."), Address: net.JoinHostPort(address, "53")})
+		}
+	}
+
+	// addresses of an IP version that the worker cannot reach, e.g. IPv6 on
+	//  an IPv4-only worker, are skipped; errors of every other address are
+	//  reported
+	supported := make(map[bool]bool)
+	var queried []*dnsZoneServer
+	var skipped []string
+	for _, server := range servers {
+		host, _, _ := net.SplitHostPort(server.Address)
+		if ip := net.ParseIP(host); ip != nil && !ip.IsLoopback() {
+			ipv6 := ip.To4() == nil
+			if _, ok := supported[ipv6]; !ok {
+				supported[ipv6] = ipVersionSupported(ipv6)
+			}
+			if !supported[ipv6] {
+				skipped = append(skipped, server.String())
+				continue
+			}
+		}
+		queried = append(queried, server)
+	}
+	if len(servers) > 0 && len(queried) == 0 {
+		problems = append(problems, "no nameserver address is reachable from this worker")
+	}
+
+	for _, server := range queried {
+		wg.Add(1)
+		go func(server *dnsZoneServer) {
+			defer wg.Done()
+			server.Err = this.query(ctx, params, server)
+		}(server)
+	}
+	wg.Wait()
+
+	var ok []*dnsZoneServer
+	for _, server := range queried {
+		if server.Err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", server, server.Err))
+		} else {
+			ok = append(ok, server)
+		}
+	}
+
+	result.Details = map[string]string{"nameservers": strconv.Itoa(len(servers))}
+	if len(skipped) > 0 {
+		result.Details["skipped"] = strings.Join(skipped, ", ")
+	}
+	if len(ok) > 0 {
+		serial, offenders := dnsZoneConsensus(ok, func(server *dnsZoneServer) string {
+			return strconv.FormatUint(uint64(server.Serial), 10)
+		})
+		result.Details["serial"] = serial
+		for _, server := range offenders {
+			problems = append(problems, fmt.Sprintf("%s: serial %d differs from %s", server, server.Serial, serial))
+		}
+
+		for i, record := range params.Records {
+			expected, offenders := dnsZoneConsensus(ok, func(server *dnsZoneServer) string {
+				return server.Records[i]
+			})
+			for _, server := range offenders {
+				problems = append(problems, fmt.Sprintf("%s: %s %s is [%s], others have [%s]", server, record.fqdn, dns.TypeToString[record.rrtype], server.Records[i], expected))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// lookup queries the resolver and returns the values of the records of the
+// requested type.
+func (this dnsZoneChecker) lookup(ctx context.Context, params *DnsZoneCheckParams, resolver string, name string, rrtype uint16) ([]string, error) {
+	msg := dns.Msg{}
+	msg.SetQuestion(name, rrtype)
+	msg.SetEdns0(4096, false)
+	reply, _, err := dnsExchange(ctx, &msg, resolver, params.Transport, time.Duration(params.Timeout) * time.Second)
+	if err != nil {
+		return nil, err
+	} else if reply.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("resolver returned %s", dns.RcodeToString[reply.Rcode])
+	}
+	var values []string
+	for _, rr := range reply.Answer {
+		if rr.Header().Rrtype == rrtype {
+			values = append(values, dnsRecordValue(rr))
+		}
+	}
+	return values, nil
+}
+
+// query fetches the SOA and records from a nameserver, which must answer
+// authoritatively for the zone.
+func (this dnsZoneChecker) query(ctx context.Context, params *DnsZoneCheckParams, server *dnsZoneServer) error {
+	timeout := time.Duration(params.Timeout) * time.Second
+	exchange := func(name string, rrtype uint16) (*dns.Msg, error) {
+		msg := dns.Msg{}
+		msg.SetQuestion(name, rrtype)
+		msg.RecursionDesired = false
+		msg.SetEdns0(4096, false)
+		reply, _, err := dnsExchange(ctx, &msg, server.Address, params.Transport, timeout)
+		if err != nil {
+			return nil, err
+		} else if reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+			return nil, fmt.Errorf("%s %s returned %s", name, dns.TypeToString[rrtype], dns.RcodeToString[reply.Rcode])
+		} else if !reply.Authoritative {
+			return nil, fmt.Errorf("lame delegation, response for %s is not authoritative", name)
+		}
+		return reply, nil
+	}
+
+	reply, err := exchange(params.Zone, dns.TypeSOA)
+	if err != nil {
+		return err
+	}
+	var found bool
+	for _, rr := range reply.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			server.Serial = soa.Serial
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("no SOA record returned")
+	}
+
+	for _, record := range params.Records {
+		reply, err := exchange(record.fqdn, record.rrtype)
+		if err != nil {
+			return err
+		}
+		var values []string
+		for _, rr := range reply.Answer {
+			if rr.Header().Rrtype == record.rrtype {
+				values = append(values, dnsRecordValue(rr))
+			}
+		}
+		if reply.Rcode == dns.RcodeNameError {
+			values = []string{"NXDOMAIN"}
+		}
+		server.Records = append(server.Records, strings.Join(dnsValueSet(record.rrtype, values), ", "))
+	}
+	return nil
+}
+
+// ipVersionSupported reports whether the worker has a route for IPv4 or IPv6
+// destinations, by connecting a UDP socket to a root server address, which
+// sends nothing.
+func ipVersionSupported(ipv6 bool) bool {
+	address := "198.41.0.4:53"
+	if ipv6 {
+		address = "[2001:503:ba3e::2:30]:53"
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// dnsZoneConsensus returns the most common value among the servers, preferring
+// the highest value on ties, and the servers that disagree with it.
+func dnsZoneConsensus(servers []*dnsZoneServer, value func(*dnsZoneServer) string) (string, []*dnsZoneServer) {
+	counts := make(map[string]int)
+	var values []string
+	for _, server := range servers {
+		v := value(server)
+		if counts[v] == 0 {
+			values = append(values, v)
+		}
+		counts[v]++
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if counts[values[i]] != counts[values[j]] {
+			return counts[values[i]] > counts[values[j]]
+		}
+		if len(values[i]) != len(values[j]) {
+			return len(values[i]) > len(values[j])
+		}
+		return values[i] > values[j]
+	})
+
+	var offenders []*dnsZoneServer
+	for _, server := range servers {
+		if value(server) != values[0] {
+			offenders = append(offenders, server)
+		}
+	}
+	return values[0], offenders
+}
@@ -0,0 +1,270 @@
+package gobearmon
+
+import "context"
+import "errors"
+import "fmt"
+import "strings"
+import "time"
+
+import "github.com/miekg/dns"
+
+// root zone trust anchors, see https://data.iana.org/root-anchors/root-anchors.xml
+var dnssecRootAnchor = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// maximum number of zones between the trust anchor and the queried name
+const maxDnssecDepth = 16
+
+// dnssecValidator validates record sets from a resolver, remembering the
+// validated keys of each zone and the earliest signature expiration.
+type dnssecValidator struct {
+	ctx context.Context
+	params *DnssecCheckParams
+	server string
+	now time.Time
+
+	keys map[string][]*dns.DNSKEY // validated keys by zone
+	expires time.Time
+	expiresOwner string // record set whose signature expires first
+}
+
+// fetch queries a record set and its signatures.
+func (this *dnssecValidator) fetch(name string, rrtype uint16) ([]dns.RR, []*dns.RRSIG, error) {
+	msg := dns.Msg{}
+	msg.SetQuestion(name, rrtype)
+	msg.SetEdns0(4096, true)
+	// let the resolver return records that it cannot validate, so we can
+	// report the actual problem
+	msg.CheckingDisabled = true
+	reply, _, err := dnsExchange(this.ctx, &msg, this.server, this.params.Transport, time.Duration(this.params.Timeout) * time.Second)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s %s query failed: %v", name, dns.TypeToString[rrtype], err)
+	} else if reply.Rcode != dns.RcodeSuccess {
+		return nil, nil, fmt.Errorf("%s %s query returned %s", name, dns.TypeToString[rrtype], dns.RcodeToString[reply.Rcode])
+	}
+
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range reply.Answer {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		} else if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype {
+			sigs = append(sigs, sig)
+		} else if rr.Header().Rrtype == rrtype {
+			rrset = append(rrset, rr)
+		}
+	}
+	return rrset, sigs, nil
+}
+
+// verify checks that one of the signatures over the record set was made by
+// one of the keys and is currently valid.
+func (this *dnssecValidator) verify(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) error {
+	name := rrset[0].Header().Name + " " + dns.TypeToString[rrset[0].Header().Rrtype]
+	if len(sigs) == 0 {
+		return fmt.Errorf("%s is not signed", name)
+	}
+
+	err := fmt.Errorf("%s is not signed by a trusted key", name)
+	for _, sig := range sigs {
+		for _, key := range keys {
+			if sig.KeyTag != key.KeyTag() || sig.Algorithm != key.Algorithm || !strings.EqualFold(sig.SignerName, key.Header().Name) {
+				continue
+			}
+			if verifyErr := sig.Verify(key, rrset); verifyErr != nil {
+				err = fmt.Errorf("%s signature by key %d is invalid: %v", name, sig.KeyTag, verifyErr)
+				continue
+			} else if !sig.ValidityPeriod(this.now) {
+				err = fmt.Errorf("%s signature by key %d expired at %s", name, sig.KeyTag, dns.TimeToString(sig.Expiration))
+				continue
+			}
+
+			expires := time.Unix(int64(sig.Expiration), 0)
+			if this.expires.IsZero() || expires.Before(this.expires) {
+				this.expires = expires
+				this.expiresOwner = name
+			}
+			return nil
+		}
+	}
+	return err
+}
+
+// zoneKeys returns the validated keys of a zone, following DS records up to
+// the trust anchor.
+func (this *dnssecValidator) zoneKeys(zone string, depth int) ([]*dns.DNSKEY, error) {
+	zone = strings.ToLower(zone)
+	if keys, ok := this.keys[zone]; ok {
+		return keys, nil
+	} else if depth > maxDnssecDepth {
+		return nil, errors.New("chain of trust is too long")
+	}
+
+	rrset, sigs, err := this.fetch(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	} else if len(rrset) == 0 {
+		return nil, fmt.Errorf("zone %s has no DNSKEY records", zone)
+	}
+	var keys []*dns.DNSKEY
+	for _, rr := range rrset {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	// the keys that the parent, or the trust anchor, vouch for
+	var trusted []*dns.DNSKEY
+	anchorZone := this.params.anchor[0].Header().Name
+	if strings.EqualFold(zone, anchorZone) {
+		trusted = dnssecMatchKeys(keys, this.params.anchor)
+		if len(trusted) == 0 {
+			return nil, fmt.Errorf("no DNSKEY of %s matches the trust anchor", zone)
+		}
+	} else {
+		if !dns.IsSubDomain(anchorZone, zone) {
+			return nil, fmt.Errorf("zone %s is outside of the trust anchor %s", zone, anchorZone)
+		}
+		dsset, dssigs, err := this.fetch(zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		} else if len(dsset) == 0 {
+			return nil, fmt.Errorf("zone %s has no DS records in its parent zone (insecure delegation)", zone)
+		} else if len(dssigs) == 0 {
+			return nil, fmt.Errorf("%s DS is not signed", zone)
+		}
+		parent := dssigs[0].SignerName
+		if strings.EqualFold(parent, zone) || !dns.IsSubDomain(parent, zone) {
+			return nil, fmt.Errorf("%s DS is signed by %s, which is not a parent zone", zone, parent)
+		}
+		parentKeys, err := this.zoneKeys(parent, depth + 1)
+		if err != nil {
+			return nil, err
+		} else if err := this.verify(dsset, dssigs, parentKeys); err != nil {
+			return nil, err
+		}
+		trusted = dnssecMatchKeys(keys, dsset)
+		if len(trusted) == 0 {
+			return nil, fmt.Errorf("no DNSKEY of %s matches its DS records", zone)
+		}
+	}
+
+	if err := this.verify(rrset, sigs, trusted); err != nil {
+		return nil, err
+	}
+	this.keys[zone] = keys
+	return keys, nil
+}
+
+// dnssecMatchKeys returns the keys that match one of the DS or DNSKEY records.
+func dnssecMatchKeys(keys []*dns.DNSKEY, anchors []dns.RR) []*dns.DNSKEY {
+	var matched []*dns.DNSKEY
+	for _, key := range keys {
+		for _, anchor := range anchors {
+			if ds, ok := anchor.(*dns.DS); ok {
+				keyDs := key.ToDS(ds.DigestType)
+				if keyDs != nil && ds.KeyTag == keyDs.KeyTag && ds.Algorithm == keyDs.Algorithm && strings.EqualFold(ds.Digest, keyDs.Digest) {
+					matched = append(matched, key)
+					break
+				}
+			} else if anchorKey, ok := anchor.(*dns.DNSKEY); ok {
+				if anchorKey.Algorithm == key.Algorithm && anchorKey.PublicKey == key.PublicKey {
+					matched = append(matched, key)
+					break
+				}
+			}
+		}
+	}
+	return matched
+}
+
+type dnssecChecker struct{}
+
+func (this dnssecChecker) Describe() string {
+	return "DNSSEC chain of trust and signature expiration"
+}
+
+func (this dnssecChecker) Parse(data string) (interface{}, error) {
+	var params DnssecCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Name == "" {
+		return nil, errors.New("name is required")
+	} else if _, ok := dnsTypeMap[strings.ToLower(params.Type)]; !ok {
+		return nil, fmt.Errorf("invalid record type: %s", params.Type)
+	} else if err := validateDnsTransport(params.Transport); err != nil {
+		return nil, err
+	} else if params.Days < 0 {
+		return nil, fmt.Errorf("days must be non-negative, got %d", params.Days)
+	}
+
+	anchors := params.TrustAnchor
+	if len(anchors) == 0 {
+		anchors = dnssecRootAnchor
+	}
+	for _, str := range anchors {
+		rr, err := dns.NewRR(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust_anchor %s: %v", str, err)
+		} else if rr == nil {
+			return nil, errors.New("empty trust_anchor")
+		} else if rr.Header().Rrtype != dns.TypeDS && rr.Header().Rrtype != dns.TypeDNSKEY {
+			return nil, fmt.Errorf("trust_anchor must be DS or DNSKEY records, got %s", dns.TypeToString[rr.Header().Rrtype])
+		} else if len(params.anchor) > 0 && !strings.EqualFold(rr.Header().Name, params.anchor[0].Header().Name) {
+			return nil, errors.New("trust_anchor records must belong to the same zone")
+		}
+		params.anchor = append(params.anchor, rr)
+	}
+	if !dns.IsSubDomain(params.anchor[0].Header().Name, dns.Fqdn(params.Name)) {
+		return nil, fmt.Errorf("name is outside of the trust anchor %s", params.anchor[0].Header().Name)
+	}
+
+	// fix parameters
+	params.Timeout = clampTimeout(params.Timeout)
+	params.Name = dns.Fqdn(params.Name)
+	return &params, nil
+}
+
+func (this dnssecChecker) Run(ctx context.Context, p interface{}, result *CheckResult) error {
+	params := p.(*DnssecCheckParams)
+	validator := &dnssecValidator{
+		ctx: ctx,
+		params: params,
+		server: dnsServerAddress(params.Server),
+		now: time.Now(),
+		keys: make(map[string][]*dns.DNSKEY),
+	}
+
+	dnsType := dnsTypeMap[strings.ToLower(params.Type)]
+	rrset, sigs, err := validator.fetch(params.Name, dnsType)
+	if err != nil {
+		return err
+	} else if len(rrset) == 0 {
+		return fmt.Errorf("%s has no %s records", params.Name, dns.TypeToString[dnsType])
+	} else if len(sigs) == 0 {
+		return fmt.Errorf("%s %s is not signed", params.Name, dns.TypeToString[dnsType])
+	}
+
+	if !dns.IsSubDomain(sigs[0].SignerName, params.Name) {
+		return fmt.Errorf("%s is signed by %s, which is not a parent zone", params.Name, sigs[0].SignerName)
+	}
+	keys, err := validator.zoneKeys(sigs[0].SignerName, 0)
+	if err != nil {
+		return err
+	} else if err := validator.verify(rrset, sigs, keys); err != nil {
+		return err
+	}
+
+	result.Details = map[string]string{
+		"signer": sigs[0].SignerName,
+		"expires": validator.expires.UTC().Format(time.RFC3339),
+	}
+	daysRemaining := int(validator.expires.Sub(validator.now).Hours() / 24)
+	if daysRemaining <= params.Days {
+		return fmt.Errorf("signature of %s expires in %d days", validator.expiresOwner, daysRemaining)
+	}
+	return nil
+}
@@ -38,6 +38,7 @@ func Launch(cfgPath string) {
 			Addr: cfg.Controller.Addr,
 			Databases: databases,
 			Confirmations: cfg.Controller.Confirmations,
+			HeartbeatAddr: cfg.Controller.HeartbeatAddr,
 		}
 		controller.Start()
 		worker := &Worker{
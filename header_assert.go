@@ -0,0 +1,78 @@
+package gobearmon
+
+import "fmt"
+import "net/http"
+import "regexp"
+import "strings"
+
+// HeaderAssertion verifies a response header. Op is one of:
+//  * present, absent: whether the header is set, Value is ignored
+//  * equals: some value of the header is exactly Value
+//  * matches: some value of the header matches the regular expression Value
+type HeaderAssertion struct {
+	Name string `json:"name"`
+	Op string `json:"op"`
+	Value string `json:"value"`
+
+	re *regexp.Regexp
+}
+
+func (this *HeaderAssertion) String() string {
+	switch this.Op {
+	case "present", "absent":
+		return fmt.Sprintf("%s %s", this.Name, this.Op)
+	case "matches":
+		return fmt.Sprintf("%s matches /%s/", this.Name, this.Value)
+	default:
+		return fmt.Sprintf("%s %s [%s]", this.Name, this.Op, this.Value)
+	}
+}
+
+// Validate checks the operator and compiles the regular expression, if any.
+func (this *HeaderAssertion) Validate() error {
+	if this.Name == "" {
+		return fmt.Errorf("header assertion: name is required")
+	}
+	switch this.Op {
+	case "present", "absent", "equals":
+	case "matches":
+		re, err := regexp.Compile(this.Value)
+		if err != nil {
+			return fmt.Errorf("header assertion on %s: invalid regular expression: %v", this.Name, err)
+		}
+		this.re = re
+	case "":
+		return fmt.Errorf("header assertion on %s: op is required", this.Name)
+	default:
+		return fmt.Errorf("header assertion on %s: unknown operator %s", this.Name, this.Op)
+	}
+	return nil
+}
+
+// Check evaluates the assertion against response headers.
+func (this *HeaderAssertion) Check(header http.Header) error {
+	values := header.Values(this.Name)
+	switch this.Op {
+	case "present":
+		if len(values) > 0 {
+			return nil
+		}
+	case "absent":
+		if len(values) == 0 {
+			return nil
+		}
+	case "equals", "matches":
+		for _, value := range values {
+			if this.Op == "equals" && value == this.Value {
+				return nil
+			} else if this.Op == "matches" && this.re.MatchString(value) {
+				return nil
+			}
+		}
+	}
+
+	if len(values) == 0 {
+		return fmt.Errorf("header assertion failed: %s (header not set)", this)
+	}
+	return fmt.Errorf("header assertion failed: %s (got [%s])", this, strings.Join(values, ", "))
+}
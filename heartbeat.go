@@ -0,0 +1,309 @@
+package gobearmon
+
+import "context"
+import "crypto/subtle"
+import "database/sql"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "log"
+import "net"
+import "net/http"
+import "regexp"
+import "strings"
+import "time"
+
+// requestor recorded for heartbeat results, which come from pings rather than
+// from workers
+const heartbeatRequestor = "heartbeat"
+
+const heartbeatDefaultGrace = 60
+const minHeartbeatTokenLength = 16
+
+// maximum length of the message reported with a ping
+const maxHeartbeatMessage = 512
+
+var heartbeatTokenRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// columns of the heartbeats table updated by each kind of ping
+var heartbeatColumns = map[string]string{
+	"start": "last_start",
+	"success": "last_success",
+	"fail": "last_failure",
+}
+
+type heartbeatState struct {
+	since time.Time // when the controller started tracking the check
+	lastStart time.Time
+	lastSuccess time.Time
+	lastFailure time.Time
+	message string // reported with the latest ping
+}
+
+func (this *heartbeatState) latest() time.Time {
+	latest := this.lastStart
+	for _, t := range []time.Time{this.lastSuccess, this.lastFailure} {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+func (this *heartbeatState) record(kind string, t time.Time, message string) {
+	switch kind {
+	case "start":
+		this.lastStart = t
+	case "success":
+		this.lastSuccess = t
+	case "fail":
+		this.lastFailure = t
+	}
+	this.message = message
+}
+
+// merge adds pings that another controller received.
+func (this *heartbeatState) merge(other *heartbeatState) {
+	if other.latest().After(this.latest()) {
+		this.message = other.message
+	}
+	if other.lastStart.After(this.lastStart) {
+		this.lastStart = other.lastStart
+	}
+	if other.lastSuccess.After(this.lastSuccess) {
+		this.lastSuccess = other.lastSuccess
+	}
+	if other.lastFailure.After(this.lastFailure) {
+		this.lastFailure = other.lastFailure
+	}
+}
+
+func isHeartbeatCheck(check *Check) bool {
+	_, ok := check.Params.(*HeartbeatCheckParams)
+	return ok
+}
+
+type heartbeatChecker struct{}
+
+func (this heartbeatChecker) Describe() string {
+	return "passive heartbeat, pinged over HTTP by a job"
+}
+
+func (this heartbeatChecker) Parse(data string) (interface{}, error) {
+	var params HeartbeatCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(params.Token) < minHeartbeatTokenLength {
+		return nil, fmt.Errorf("token must be at least %d characters", minHeartbeatTokenLength)
+	} else if !heartbeatTokenRegexp.MatchString(params.Token) {
+		return nil, errors.New("token may only contain letters, digits, - and _")
+	} else if params.Grace != nil && *params.Grace < 0 {
+		return nil, fmt.Errorf("grace must be non-negative, got %d", *params.Grace)
+	} else if params.MaxRuntime < 0 {
+		return nil, fmt.Errorf("max_runtime must be non-negative, got %d", params.MaxRuntime)
+	}
+
+	// fix parameters
+	params.grace = heartbeatDefaultGrace * time.Second
+	if params.Grace != nil {
+		params.grace = time.Duration(*params.Grace) * time.Second
+	}
+	return &params, nil
+}
+
+func (this heartbeatChecker) Run(ctx context.Context, p interface{}, result *CheckResult) error {
+	return errors.New("heartbeat checks are evaluated by the controller from received pings")
+}
+
+// heartbeatResult evaluates the pings received for a heartbeat check. The
+// lock must be held.
+func (this *Controller) heartbeatResult(check *Check, params *HeartbeatCheckParams, now time.Time) *CheckResult {
+	state := this.heartbeats[check.Id]
+	if state == nil {
+		state = &heartbeatState{since: now}
+		this.heartbeats[check.Id] = state
+	}
+
+	result := &CheckResult{
+		Status: StatusOnline,
+		Details: make(map[string]string),
+	}
+	if !state.lastSuccess.IsZero() {
+		result.Details["last_success"] = state.lastSuccess.UTC().Format(time.RFC3339)
+	}
+	if state.message != "" {
+		result.Details["ping_message"] = state.message
+	}
+
+	deadline := time.Duration(check.Interval) * time.Second + params.grace
+	maxRuntime := time.Duration(params.MaxRuntime) * time.Second
+	var err error
+	if state.lastFailure.After(state.lastSuccess) {
+		err = fmt.Errorf("job reported failure at %s", state.lastFailure.UTC().Format(time.RFC3339))
+		if state.message != "" {
+			err = fmt.Errorf("%v: %s", err, state.message)
+		}
+	} else if state.lastSuccess.IsZero() && now.Sub(state.since) > deadline {
+		err = fmt.Errorf("no heartbeat received since monitoring started at %s", state.since.UTC().Format(time.RFC3339))
+	} else if !state.lastSuccess.IsZero() && now.Sub(state.lastSuccess) > deadline {
+		err = fmt.Errorf("last heartbeat was %v ago, expected every %d seconds", roundDuration(now.Sub(state.lastSuccess)), check.Interval)
+	} else if maxRuntime > 0 && state.lastStart.After(state.lastSuccess) && state.lastStart.After(state.lastFailure) && now.Sub(state.lastStart) > maxRuntime {
+		err = fmt.Errorf("job started at %s has not finished within %d seconds", state.lastStart.UTC().Format(time.RFC3339), params.MaxRuntime)
+	}
+	if err != nil {
+		result.Status = StatusOffline
+		result.Message = err.Error()
+	}
+	return result
+}
+
+// heartbeatPing records a ping for every heartbeat check with the token, and
+// persists it so that a controller taking over later knows about it. It
+// returns the number of matching checks.
+func (this *Controller) heartbeatPing(token string, kind string, message string, t time.Time) int {
+	var checkIds []CheckId
+	this.mu.Lock()
+	for checkId, check := range this.checks {
+		params, ok := check.Params.(*HeartbeatCheckParams)
+		if !ok || subtle.ConstantTimeCompare([]byte(params.Token), []byte(token)) != 1 {
+			continue
+		}
+		state := this.heartbeats[checkId]
+		if state == nil {
+			state = &heartbeatState{since: t}
+			this.heartbeats[checkId] = state
+		}
+		state.record(kind, t, message)
+		checkIds = append(checkIds, checkId)
+		debugPrintf("received heartbeat %s ping for check [%s]", kind, check.Name)
+	}
+	this.mu.Unlock()
+
+	column := heartbeatColumns[kind]
+	query := fmt.Sprintf("INSERT INTO heartbeats (check_id, %s, message) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE %s = GREATEST(%s, VALUES(%s)), message = VALUES(message)", column, column, column, column)
+	for _, checkId := range checkIds {
+		checkId := checkId
+		go func() {
+			success := retry(func() error {
+				_, err := this.randomDB().Exec(query, checkId, t.Unix(), message)
+				return err
+			}, 10)
+			if !success {
+				log.Printf("controller: failed to store heartbeat ping for check %d", checkId)
+			}
+		}()
+	}
+	return len(checkIds)
+}
+
+// loadHeartbeats reads the pings persisted by all controllers.
+func loadHeartbeats(db *sql.DB) (map[CheckId]*heartbeatState, error) {
+	rows, err := db.Query("SELECT check_id, last_start, last_success, last_failure, message FROM heartbeats")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	unixTime := func(sec int64) time.Time {
+		if sec == 0 {
+			return time.Time{}
+		}
+		return time.Unix(sec, 0)
+	}
+	states := make(map[CheckId]*heartbeatState)
+	for rows.Next() {
+		var checkId CheckId
+		var start, success, failure int64
+		var message string
+		err := rows.Scan(&checkId, &start, &success, &failure, &message)
+		if err != nil {
+			return nil, err
+		}
+		states[checkId] = &heartbeatState{
+			lastStart: unixTime(start),
+			lastSuccess: unixTime(success),
+			lastFailure: unixTime(failure),
+			message: message,
+		}
+	}
+	return states, rows.Err()
+}
+
+// mergeHeartbeats starts tracking new heartbeat checks, forgets removed ones,
+// and adds the persisted pings. The lock must be held.
+func (this *Controller) mergeHeartbeats(stored map[CheckId]*heartbeatState, now time.Time) {
+	for checkId := range this.heartbeats {
+		if check := this.checks[checkId]; check == nil || !isHeartbeatCheck(check) {
+			delete(this.heartbeats, checkId)
+		}
+	}
+	for checkId, check := range this.checks {
+		if !isHeartbeatCheck(check) {
+			continue
+		}
+		state := this.heartbeats[checkId]
+		if state == nil {
+			state = &heartbeatState{since: now}
+			this.heartbeats[checkId] = state
+		}
+		if stored[checkId] != nil {
+			state.merge(stored[checkId])
+		}
+	}
+}
+
+func (this *Controller) serveHeartbeats(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/heartbeat/", this.handleHeartbeat)
+	server := &http.Server{
+		Handler: mux,
+		ReadTimeout: 10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	log.Printf("controller: heartbeat server stopped: %s", server.Serve(ln).Error())
+}
+
+// handleHeartbeat serves /heartbeat/{token} and /heartbeat/{token}/{kind},
+// where kind is start, success (the default) or fail. The message is the
+// msg query parameter or the POST body.
+func (this *Controller) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" && r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/heartbeat/"), "/")
+	kind := "success"
+	if len(parts) == 2 && heartbeatColumns[parts[1]] != "" {
+		kind = parts[1]
+	} else if len(parts) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	message := r.URL.Query().Get("msg")
+	if r.Method == "POST" {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxHeartbeatMessage))
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		} else if len(body) > 0 {
+			message = string(body)
+		}
+	}
+	message = strings.TrimSpace(message)
+	if len(message) > maxHeartbeatMessage {
+		message = message[:maxHeartbeatMessage]
+	}
+	message = strings.ToValidUTF8(message, "")
+
+	if this.heartbeatPing(parts[0], kind, message, time.Now()) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
@@ -0,0 +1,326 @@
+package gobearmon
+
+import "context"
+import "crypto/tls"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptrace"
+import "net/url"
+import "regexp"
+import "strings"
+import "sync"
+import "time"
+
+// references to http_flow variables, e.g. {{token}}
+var httpVariablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_]+)\s*\}\}`)
+
+// prepareClient validates the client options and fills in defaults; it must be
+// called from the check type's Parse.
+func (this *HttpClientParams) prepareClient() error {
+	if err := this.loadTls(); err != nil {
+		return err
+	} else if this.MaxRedirects < 0 {
+		return errors.New("max_redirects must be non-negative")
+	}
+
+	// fix parameters
+	this.Timeout = clampTimeout(this.Timeout)
+	if this.MaxRedirects == 0 {
+		this.MaxRedirects = 10
+	}
+	return nil
+}
+
+// newClient creates an HTTP client that records the URL of each followed
+// redirect in chain.
+func (this *HttpClientParams) newClient(chain *[]string, jar http.CookieJar) *http.Client {
+	return &http.Client{
+		Timeout: time.Duration(this.Timeout) * time.Second,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig: this.tlsConfig(""),
+		},
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if this.FollowRedirects != nil && !*this.FollowRedirects {
+				return http.ErrUseLastResponse
+			}
+			*chain = append(*chain, request.URL.String())
+			if len(via) > this.MaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", this.MaxRedirects)
+			}
+			return nil
+		},
+		Jar: jar,
+	}
+}
+
+// prepareRequest validates the request and expectations and fills in
+// defaults; it must be called from the check type's Parse. If templated is
+// set, the URL is only validated when it does not reference variables.
+func (this *HttpRequestParams) prepareRequest(templated bool) error {
+	if this.Url == "" {
+		return errors.New("url is required")
+	}
+	if !templated || !httpVariablePattern.MatchString(this.Url) {
+		u, err := url.Parse(this.Url)
+		if err != nil {
+			return fmt.Errorf("invalid url: %v", err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid url scheme [%s], expected http or https", u.Scheme)
+		} else if u.Host == "" {
+			return errors.New("url is missing host")
+		}
+	}
+
+	if err := this.compile(); err != nil {
+		return err
+	}
+	for _, assertion := range this.ExpectJson {
+		if assertion == nil {
+			return errors.New("expect_json contains a null assertion")
+		} else if err := assertion.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, assertion := range this.ExpectHeaders {
+		if assertion == nil {
+			return errors.New("expect_headers contains a null assertion")
+		} else if err := assertion.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// fix parameters
+	if this.Method == "" {
+		if this.Body == "" {
+			this.Method = "GET"
+		} else {
+			this.Method = "POST"
+		}
+	}
+	return nil
+}
+
+// variables returns the names of variables referenced by the request.
+func (this *HttpRequestParams) variables() []string {
+	var names []string
+	templates := []string{this.Url, this.Body, this.Username, this.Password}
+	for _, v := range this.Headers {
+		templates = append(templates, v)
+	}
+	for _, template := range templates {
+		for _, match := range httpVariablePattern.FindAllStringSubmatch(template, -1) {
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// newRequest creates the HTTP request. If vars is not nil, variable references
+// are replaced by their values.
+func (this *HttpRequestParams) newRequest(ctx context.Context, vars map[string]string) (*http.Request, error) {
+	expand := func(template string) string {
+		if vars == nil {
+			return template
+		}
+		return httpVariablePattern.ReplaceAllStringFunc(template, func(match string) string {
+			return vars[httpVariablePattern.FindStringSubmatch(match)[1]]
+		})
+	}
+
+	// values substituted into a path segment or the query are escaped so
+	//  that they cannot change the structure of the URL; a value at the start
+	//  of the URL, e.g. an extracted Location, is inserted as is, and so are
+	//  values in the scheme or host
+	expandUrl := func(template string) string {
+		if vars == nil {
+			return template
+		}
+		pathStart := 0
+		if i := strings.Index(template, "://"); i >= 0 {
+			pathStart = len(template)
+			if j := strings.Index(template[i + 3:], "/"); j >= 0 {
+				pathStart = i + 3 + j
+			}
+		}
+		query := strings.Index(template, "?")
+		var expanded strings.Builder
+		var last int
+		for _, loc := range httpVariablePattern.FindAllStringSubmatchIndex(template, -1) {
+			value := vars[template[loc[2]:loc[3]]]
+			if loc[0] > 0 && loc[0] >= pathStart && query >= 0 && loc[0] > query {
+				value = url.QueryEscape(value)
+			} else if loc[0] > 0 && loc[0] >= pathStart {
+				value = url.PathEscape(value)
+			}
+			expanded.WriteString(template[last:loc[0]])
+			expanded.WriteString(value)
+			last = loc[1]
+		}
+		expanded.WriteString(template[last:])
+		return expanded.String()
+	}
+
+	// use a strings.Reader so that the body can be resent on 307/308 redirects
+	var body io.Reader
+	if len(this.Body) > 0 {
+		body = strings.NewReader(expand(this.Body))
+	}
+
+	request, err := http.NewRequestWithContext(ctx, this.Method, expandUrl(this.Url), body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating HTTP request: %v", err)
+	}
+
+	request.Header = http.Header{"User-Agent": {"gobearmon"}}
+	for k, v := range this.Headers {
+		if k == "Host" {
+			request.Host = expand(v)
+		} else {
+			request.Header.Set(k, expand(v))
+		}
+	}
+
+	if this.Username != "" {
+		request.SetBasicAuth(expand(this.Username), expand(this.Password))
+	}
+
+	return request, nil
+}
+
+// needsBody returns whether verify requires the response body.
+func (this *HttpRequestParams) needsBody() bool {
+	return this.ExpectSubstring != "" || len(this.ExpectJson) > 0 || this.active()
+}
+
+// readBody reads the response body if it is needed by verify or by the caller.
+func (this *HttpRequestParams) readBody(response *http.Response, needed bool) ([]byte, error) {
+	if !needed && !this.needsBody() {
+		return nil, nil
+	}
+	bytes, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading HTTP response body: %v", err)
+	}
+	return bytes, nil
+}
+
+// verify checks the response against the expectations.
+func (this *HttpRequestParams) verify(response *http.Response, body []byte) error {
+	if this.ExpectStatus != 0 && this.ExpectStatus != response.StatusCode {
+		return fmt.Errorf("status mismatch, got %d but expected %d", response.StatusCode, this.ExpectStatus)
+	}
+
+	for _, assertion := range this.ExpectHeaders {
+		err := assertion.Check(response.Header)
+		if err != nil {
+			return err
+		}
+	}
+
+	finalUrl := response.Request.URL.String()
+	if this.ExpectUrl != "" && this.ExpectUrl != finalUrl {
+		return fmt.Errorf("final URL mismatch, got [%s] but expected [%s]", finalUrl, this.ExpectUrl)
+	}
+	if this.ExpectLocation != "" && this.ExpectLocation != response.Header.Get("Location") {
+		return fmt.Errorf("Location header mismatch, got [%s] but expected [%s]", response.Header.Get("Location"), this.ExpectLocation)
+	}
+
+	if this.ExpectSubstring != "" && !strings.Contains(string(body), this.ExpectSubstring) {
+		return fmt.Errorf("expected substring [%s] was not found in the response body", this.ExpectSubstring)
+	}
+	if err := this.match(string(body), "response body"); err != nil {
+		return err
+	}
+
+	if len(this.ExpectJson) > 0 {
+		var doc interface{}
+		err := json.Unmarshal(body, &doc)
+		if err != nil {
+			return fmt.Errorf("response body is not valid JSON: %v", err)
+		}
+		for _, assertion := range this.ExpectJson {
+			err := assertion.Check(doc)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// httpTimings records the duration of each request phase. Phases are summed
+// over redirects, except that time to first byte is measured from start to the
+// final response. The trace callbacks may run concurrently and after the
+// request completed, so they are ignored once finish is called.
+type httpTimings struct {
+	mu sync.Mutex
+	start time.Time
+	dnsStart time.Time
+	connectStart map[string]time.Time // by address, as dual-stack dials run in parallel
+	tlsStart time.Time
+	timings map[string]time.Duration
+	finished bool
+}
+
+func newHttpTimings(start time.Time) *httpTimings {
+	return &httpTimings{
+		start: start,
+		connectStart: make(map[string]time.Time),
+		timings: make(map[string]time.Duration),
+	}
+}
+
+// record calls f with the lock held, unless finish was called.
+func (this *httpTimings) record(f func()) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if !this.finished {
+		f()
+	}
+}
+
+func (this *httpTimings) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			this.record(func() { this.dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			this.record(func() { this.timings[TimingDNS] += time.Since(this.dnsStart) })
+		},
+		ConnectStart: func(network string, addr string) {
+			this.record(func() { this.connectStart[network + "/" + addr] = time.Now() })
+		},
+		ConnectDone: func(network string, addr string, err error) {
+			// only the connection that is used counts
+			this.record(func() {
+				if start, ok := this.connectStart[network + "/" + addr]; ok && err == nil {
+					this.timings[TimingConnect] += time.Since(start)
+				}
+				delete(this.connectStart, network + "/" + addr)
+			})
+		},
+		TLSHandshakeStart: func() {
+			this.record(func() { this.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			this.record(func() { this.timings[TimingTLS] += time.Since(this.tlsStart) })
+		},
+		GotFirstResponseByte: func() {
+			this.record(func() { this.timings[TimingFirstByte] = time.Since(this.start) })
+		},
+	}
+}
+
+// finish stops recording and returns the timings.
+func (this *httpTimings) finish() map[string]time.Duration {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.finished = true
+	return this.timings
+}
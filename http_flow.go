@@ -0,0 +1,210 @@
+package gobearmon
+
+import "context"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "net/http"
+import "net/http/cookiejar"
+import "regexp"
+import "strings"
+import "time"
+
+// maximum number of requests in an http_flow check
+const maxHttpFlowSteps = 20
+
+var httpVariableNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// HttpExtraction stores a value from a response in a variable for use by later
+// steps of an http_flow check. From is one of:
+//  * json: the value at Path in the JSON response body (see JsonAssertion)
+//  * header: the value of the response header Header
+//  * regex: the first capture group (or entire match) of Regex in the body
+type HttpExtraction struct {
+	Var string `json:"var"`
+	From string `json:"from"`
+	Path string `json:"path"`
+	Header string `json:"header"`
+	Regex string `json:"regex"`
+
+	segments []interface{}
+	re *regexp.Regexp
+}
+
+// Validate checks the source options and compiles the path or expression.
+func (this *HttpExtraction) Validate() error {
+	if !httpVariableNamePattern.MatchString(this.Var) {
+		return fmt.Errorf("extract: invalid variable name [%s]", this.Var)
+	}
+	switch this.From {
+	case "json":
+		segments, err := parseJsonPath(this.Path)
+		if err != nil {
+			return fmt.Errorf("extract %s: invalid path %s: %v", this.Var, this.Path, err)
+		}
+		this.segments = segments
+	case "header":
+		if this.Header == "" {
+			return fmt.Errorf("extract %s: header is required", this.Var)
+		}
+	case "regex":
+		re, err := regexp.Compile(this.Regex)
+		if err != nil {
+			return fmt.Errorf("extract %s: invalid regular expression: %v", this.Var, err)
+		}
+		this.re = re
+	default:
+		return fmt.Errorf("extract %s: from must be json, header or regex", this.Var)
+	}
+	return nil
+}
+
+// Extract returns the value from the response.
+func (this *HttpExtraction) Extract(response *http.Response, body []byte) (string, error) {
+	switch this.From {
+	case "json":
+		var doc interface{}
+		err := json.Unmarshal(body, &doc)
+		if err != nil {
+			return "", fmt.Errorf("extract %s: response body is not valid JSON: %v", this.Var, err)
+		}
+		value, found := lookupJsonPath(doc, this.segments)
+		if !found {
+			return "", fmt.Errorf("extract %s: path %s not found in response body", this.Var, this.Path)
+		} else if str, ok := value.(string); ok {
+			return str, nil
+		}
+		bytes, _ := json.Marshal(value)
+		return string(bytes), nil
+	case "header":
+		value := response.Header.Get(this.Header)
+		if value == "" {
+			return "", fmt.Errorf("extract %s: header %s not set", this.Var, this.Header)
+		}
+		return value, nil
+	default:
+		match := this.re.FindSubmatch(body)
+		if match == nil {
+			return "", fmt.Errorf("extract %s: /%s/ did not match the response body (received [%s])", this.Var, this.re, snippet(string(body), 0))
+		} else if len(match) > 1 {
+			return string(match[1]), nil
+		}
+		return string(match[0]), nil
+	}
+}
+
+type httpFlowChecker struct{}
+
+func (this httpFlowChecker) Describe() string {
+	return "sequence of HTTP requests sharing cookies, with values extracted from earlier responses"
+}
+
+func (this httpFlowChecker) Parse(data string) (interface{}, error) {
+	var params HttpFlowCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(params.Steps) == 0 {
+		return nil, errors.New("at least one step is required")
+	} else if len(params.Steps) > maxHttpFlowSteps {
+		return nil, fmt.Errorf("at most %d steps are allowed", maxHttpFlowSteps)
+	} else if err := params.prepareClient(); err != nil {
+		return nil, err
+	}
+
+	// every variable must be extracted by an earlier step
+	defined := make(map[string]bool)
+	for i, step := range params.Steps {
+		if step == nil {
+			return nil, fmt.Errorf("step %d is null", i + 1)
+		} else if err := step.prepareRequest(true); err != nil {
+			return nil, fmt.Errorf("step %s: %v", step.label(i), err)
+		}
+		for _, name := range step.variables() {
+			if !defined[name] {
+				return nil, fmt.Errorf("step %s: variable %s is not extracted by an earlier step", step.label(i), name)
+			}
+		}
+		for _, extraction := range step.Extract {
+			if extraction == nil {
+				return nil, fmt.Errorf("step %s: extract contains a null entry", step.label(i))
+			} else if err := extraction.Validate(); err != nil {
+				return nil, fmt.Errorf("step %s: %v", step.label(i), err)
+			}
+			defined[extraction.Var] = true
+		}
+	}
+
+	if total := time.Duration(len(params.Steps) * params.Timeout) * time.Second; total > checkTimeout {
+		return nil, fmt.Errorf("steps may take up to %v in total, reduce the number of steps or the timeout", total)
+	}
+
+	return &params, nil
+}
+
+func (this httpFlowChecker) Run(ctx context.Context, p interface{}, result *CheckResult) error {
+	params := p.(*HttpFlowCheckParams)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	vars := make(map[string]string)
+	result.Timings = make(map[string]time.Duration)
+
+	for i, step := range params.Steps {
+		start := time.Now()
+		err := step.run(ctx, params, jar, vars)
+		result.Timings["step:" + step.label(i)] = time.Since(start)
+		if err != nil {
+			return fmt.Errorf("step %s failed: %v", step.label(i), err)
+		}
+	}
+	return nil
+}
+
+// label identifies the step in messages.
+func (this *HttpFlowStep) label(index int) string {
+	if this.Name != "" {
+		return fmt.Sprintf("%d (%s)", index + 1, this.Name)
+	}
+	return fmt.Sprintf("%d", index + 1)
+}
+
+func (this *HttpFlowStep) run(ctx context.Context, params *HttpFlowCheckParams, jar http.CookieJar, vars map[string]string) (err error) {
+	request, err := this.newRequest(ctx, vars)
+	if err != nil {
+		return err
+	}
+
+	chain := []string{request.URL.String()}
+	defer func() {
+		if err != nil && len(chain) > 1 {
+			err = fmt.Errorf("%v (redirect chain: %s)", err, strings.Join(chain, " -> "))
+		}
+	}()
+
+	response, err := params.newClient(&chain, jar).Do(request)
+	if err != nil {
+		return fmt.Errorf("error performing HTTP request: %v", err)
+	}
+	defer response.Body.Close()
+
+	body, err := this.readBody(response, len(this.Extract) > 0)
+	if err != nil {
+		return err
+	} else if err := this.verify(response, body); err != nil {
+		return err
+	}
+
+	for _, extraction := range this.Extract {
+		value, err := extraction.Extract(response, body)
+		if err != nil {
+			return err
+		}
+		vars[extraction.Var] = value
+	}
+	return nil
+}
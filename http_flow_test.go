@@ -0,0 +1,52 @@
+package gobearmon
+
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "testing"
+
+func TestHttpFlowVariablesInUrl(t *testing.T) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			// the next location carries a query, and the token characters
+			// that would change the URL if inserted unescaped
+			w.Header().Set("Location", server.URL + "/landing?session=abc")
+			w.Header().Set("X-Token", "a/b?c&d#e")
+			w.WriteHeader(http.StatusFound)
+		case "/landing":
+			if r.URL.Query().Get("session") != "abc" {
+				http.Error(w, "bad session", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "landed")
+		case "/items/a/b?c&d#e":
+			if r.URL.Query().Get("token") != "a/b?c&d#e" {
+				http.Error(w, "bad token", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "item")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	data := fmt.Sprintf(`{"follow_redirects":false,"steps":[
+		{"name":"login","url":"%s/login","expect_status":302,"extract":[{"var":"next","from":"header","header":"Location"},{"var":"token","from":"header","header":"X-Token"}]},
+		{"name":"landing","url":"{{next}}","expect_substrings":["landed"]},
+		{"name":"item","url":"%s/items/{{token}}?token={{token}}","expect_substrings":["item"]}
+	]}`, server.URL, server.URL)
+	params, err := ParseCheck("http_flow", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := DoCheck(&Check{Name: "flow", Type: "http_flow", Data: data, Params: params})
+	if result.Status != StatusOnline {
+		t.Fatalf("expected online, got %s: %s", result.Status, result.Message)
+	}
+}
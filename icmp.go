@@ -0,0 +1,226 @@
+package gobearmon
+
+import "bytes"
+import "context"
+import "crypto/rand"
+import "fmt"
+import "net"
+import "os"
+import "sort"
+import "time"
+
+import "golang.org/x/net/icmp"
+import "golang.org/x/net/ipv4"
+import "golang.org/x/net/ipv6"
+
+type pingStats struct {
+	Sent int
+	Received int
+	Min time.Duration
+	Avg time.Duration
+	Max time.Duration
+	Jitter time.Duration // mean difference between consecutive round-trip times
+}
+
+// Loss returns the percentage of echo requests that were not answered.
+func (this *pingStats) Loss() int {
+	if this.Sent == 0 {
+		return 100
+	}
+	return (this.Sent - this.Received) * 100 / this.Sent
+}
+
+func (this *pingStats) String() string {
+	return fmt.Sprintf("%d/%d received, rtt min/avg/max/jitter = %v/%v/%v/%v", this.Received, this.Sent, roundDuration(this.Min), roundDuration(this.Avg), roundDuration(this.Max), roundDuration(this.Jitter))
+}
+
+type pingReply struct {
+	seq int
+	at time.Time
+}
+
+// resolvePingTarget resolves the target to a single address, preferring IPv4
+// unless forceIP is 6.
+func resolvePingTarget(ctx context.Context, target string, forceIP int) (net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", target, err)
+	}
+	for _, addr := range addrs {
+		isV4 := addr.IP.To4() != nil
+		if (forceIP == 6) != isV4 {
+			return addr.IP, nil
+		}
+	}
+	if forceIP == 0 && len(addrs) > 0 {
+		return addrs[0].IP, nil
+	} else if forceIP == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", target)
+	} else {
+		return nil, fmt.Errorf("no IPv%d address found for %s", forceIP, target)
+	}
+}
+
+// listenPing opens an unprivileged ICMP datagram socket, falling back to a raw
+// socket if datagram sockets are not permitted (on Linux, this is controlled by
+// the net.ipv4.ping_group_range sysctl).
+func listenPing(ip net.IP) (*icmp.PacketConn, bool, error) {
+	network, rawNetwork, address := "udp4", "ip4:icmp", "0.0.0.0"
+	if ip.To4() == nil {
+		network, rawNetwork, address = "udp6", "ip6:ipv6-icmp", "::"
+	}
+	conn, err := icmp.ListenPacket(network, address)
+	if err == nil {
+		return conn, false, nil
+	}
+	conn, rawErr := icmp.ListenPacket(rawNetwork, address)
+	if rawErr != nil {
+		return nil, false, fmt.Errorf("failed to open ICMP socket (%v) or raw socket (%v)", err, rawErr)
+	}
+	return conn, true, nil
+}
+
+// ping sends count echo requests to ip, interval apart, and then waits up to
+// timeout for outstanding replies.
+func ping(ctx context.Context, ip net.IP, count int, interval time.Duration, timeout time.Duration) (*pingStats, error) {
+	conn, raw, err := listenPing(ip)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	if raw {
+		dst = &net.IPAddr{IP: ip}
+	}
+	var requestType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	proto := 1
+	if ip.To4() == nil {
+		requestType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		proto = 58
+	}
+
+	// on datagram sockets the kernel assigns the identifier and only delivers
+	//  our own replies; on raw sockets we see every reply, so we match on the
+	//  identifier and a random payload
+	id := os.Getpid() & 0xffff
+	token := make([]byte, 16)
+	rand.Read(token)
+
+	replies := make(chan pingReply, count)
+	go func() {
+		defer close(replies)
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			at := time.Now()
+			msg, err := icmp.ParseMessage(proto, buf[:n])
+			if err != nil || msg.Type != replyType {
+				continue
+			}
+			echo, ok := msg.Body.(*icmp.Echo)
+			if !ok || !bytes.Equal(echo.Data, token) || (raw && echo.ID != id) {
+				continue
+			}
+			select {
+			case replies <- pingReply{seq: echo.Seq, at: at}:
+			default:
+			}
+		}
+	}()
+
+	sentAt := make(map[int]time.Time)
+	rtts := make(map[int]time.Duration)
+	var sendErr error
+	send := func() {
+		seq := len(sentAt)
+		msg := icmp.Message{
+			Type: requestType,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: token},
+		}
+		packet, err := msg.Marshal(nil)
+		if err != nil {
+			panic(err)
+		}
+		sentAt[seq] = time.Now()
+		_, err = conn.WriteTo(packet, dst)
+		if err != nil {
+			sendErr = err
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var deadline <-chan time.Time
+	send()
+	if count == 1 {
+		deadline = time.After(timeout)
+	}
+
+loop:
+	for len(rtts) < count {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-deadline:
+			break loop
+		case <-ticker.C:
+			if len(sentAt) < count {
+				send()
+				if len(sentAt) == count {
+					deadline = time.After(timeout)
+				}
+			}
+		case reply, ok := <-replies:
+			if !ok {
+				break loop
+			}
+			t, ok := sentAt[reply.seq]
+			if _, duplicate := rtts[reply.seq]; ok && !duplicate {
+				rtts[reply.seq] = reply.at.Sub(t)
+			}
+		}
+	}
+
+	if len(rtts) == 0 && sendErr != nil {
+		return nil, fmt.Errorf("failed to send echo request: %v", sendErr)
+	}
+
+	stats := &pingStats{
+		Sent: len(sentAt),
+		Received: len(rtts),
+	}
+	var seqs []int
+	for seq := range rtts {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	var sum, jitterSum time.Duration
+	for i, seq := range seqs {
+		rtt := rtts[seq]
+		sum += rtt
+		if i == 0 || rtt < stats.Min {
+			stats.Min = rtt
+		}
+		if rtt > stats.Max {
+			stats.Max = rtt
+		}
+		if i > 0 {
+			diff := rtt - rtts[seqs[i - 1]]
+			if diff < 0 {
+				diff = -diff
+			}
+			jitterSum += diff
+		}
+	}
+	if len(seqs) > 0 {
+		stats.Avg = sum / time.Duration(len(seqs))
+	}
+	if len(seqs) > 1 {
+		stats.Jitter = jitterSum / time.Duration(len(seqs) - 1)
+	}
+	return stats, nil
+}
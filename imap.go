@@ -0,0 +1,213 @@
+package gobearmon
+
+import "bufio"
+import "context"
+import "crypto/tls"
+import "fmt"
+import "net"
+import "regexp"
+import "strconv"
+import "strings"
+import "time"
+
+// imapSession is a minimal IMAP client supporting the commands needed to find
+// and delete messages.
+type imapSession struct {
+	conn net.Conn
+	in *bufio.Reader
+	timeout time.Duration // applied to each command, if set
+	tag int
+	capabilities []string // requested by HasCapability after login
+}
+
+func dialImap(ctx context.Context, address string, timeout time.Duration, implicitTls bool, tlsConfig *tls.Config) (*imapSession, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("connection error: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if implicitTls {
+		tlsConn, err := tlsHandshake(ctx, conn, tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return &imapSession{
+		conn: conn,
+		in: bufio.NewReader(conn),
+		timeout: timeout,
+	}, nil
+}
+
+func (this *imapSession) Close() error {
+	return this.conn.Close()
+}
+
+func (this *imapSession) Greeting() error {
+	line, err := readLine(this.in)
+	if err != nil {
+		return fmt.Errorf("greeting: %v", err)
+	} else if !strings.HasPrefix(line, "* OK") {
+		return fmt.Errorf("unexpected greeting [%s]", line)
+	}
+	return nil
+}
+
+// cmd sends a tagged command and returns the untagged responses. If display
+// is set, it is used in place of the command in error messages, to avoid
+// leaking credentials.
+func (this *imapSession) cmd(command string, display string) ([]string, error) {
+	if display == "" {
+		display = command
+	}
+	if this.timeout > 0 {
+		this.conn.SetDeadline(time.Now().Add(this.timeout))
+	}
+	this.tag++
+	tag := "a" + strconv.Itoa(this.tag)
+	err := writeLine(this.conn, tag + " " + command)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", display, err)
+	}
+
+	var untagged []string
+	for {
+		line, err := readLine(this.in)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", display, err)
+		} else if strings.HasPrefix(line, tag + " OK") {
+			return untagged, nil
+		} else if strings.HasPrefix(line, tag + " ") {
+			return nil, fmt.Errorf("%s: %s", display, strings.TrimPrefix(line, tag + " "))
+		} else if strings.HasPrefix(line, "* ") {
+			untagged = append(untagged, line[2:])
+		}
+	}
+}
+
+func (this *imapSession) StartTls(ctx context.Context, tlsConfig *tls.Config) error {
+	if _, err := this.cmd("STARTTLS", ""); err != nil {
+		return err
+	}
+	tlsConn, err := tlsHandshake(ctx, this.conn, tlsConfig)
+	if err != nil {
+		return err
+	}
+	this.conn = tlsConn
+	this.in = bufio.NewReader(tlsConn)
+	return nil
+}
+
+func (this *imapSession) Login(username string, password string) error {
+	_, err := this.cmd("LOGIN " + imapQuote(username) + " " + imapQuote(password), "LOGIN")
+	return err
+}
+
+func (this *imapSession) Select(mailbox string) error {
+	_, err := this.cmd("SELECT " + imapQuote(mailbox), "")
+	return err
+}
+
+// SearchSubject returns the UIDs of messages whose subject contains the string.
+func (this *imapSession) SearchSubject(subject string) ([]string, error) {
+	// NOOP lets the server report newly delivered messages
+	if _, err := this.cmd("NOOP", ""); err != nil {
+		return nil, err
+	}
+	lines, err := this.cmd("UID SEARCH SUBJECT " + imapQuote(subject), "")
+	if err != nil {
+		return nil, err
+	}
+	var uids []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "SEARCH") {
+			uids = append(uids, strings.Fields(line)[1:]...)
+		}
+	}
+	return uids, nil
+}
+
+// attributes of FETCH responses, which may appear in any order
+var imapUidPattern = regexp.MustCompile(`UID (\d+)`)
+var imapInternalDatePattern = regexp.MustCompile(`INTERNALDATE "([^"]+)"`)
+
+// SearchSubjectBefore returns the UIDs of messages whose subject contains the
+// string and that arrived before the given time.
+func (this *imapSession) SearchSubjectBefore(subject string, before time.Time) ([]string, error) {
+	uids, err := this.SearchSubject(subject)
+	if err != nil || len(uids) == 0 {
+		return nil, err
+	}
+	lines, err := this.cmd("UID FETCH " + strings.Join(uids, ",") + " (UID INTERNALDATE)", "")
+	if err != nil {
+		return nil, err
+	}
+	var older []string
+	for _, line := range lines {
+		uid := imapUidPattern.FindStringSubmatch(line)
+		date := imapInternalDatePattern.FindStringSubmatch(line)
+		if uid == nil || date == nil {
+			continue
+		}
+		t, err := time.Parse("_2-Jan-2006 15:04:05 -0700", date[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid INTERNALDATE [%s]", date[1])
+		} else if t.Before(before) {
+			older = append(older, uid[1])
+		}
+	}
+	return older, nil
+}
+
+// HasCapability reports whether the server advertises the capability; it
+// should be called after login, as servers may advertise more then.
+func (this *imapSession) HasCapability(capability string) (bool, error) {
+	if this.capabilities == nil {
+		lines, err := this.cmd("CAPABILITY", "")
+		if err != nil {
+			return false, err
+		}
+		this.capabilities = []string{}
+		for _, line := range lines {
+			if strings.HasPrefix(line, "CAPABILITY ") {
+				this.capabilities = append(this.capabilities, strings.Fields(line)[1:]...)
+			}
+		}
+	}
+	for _, c := range this.capabilities {
+		if strings.EqualFold(c, capability) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Delete removes the messages. With UIDPLUS only these messages are expunged;
+// otherwise EXPUNGE also removes any other message flagged as deleted.
+func (this *imapSession) Delete(uids []string) error {
+	if _, err := this.cmd("UID STORE " + strings.Join(uids, ",") + " +FLAGS.SILENT (\\Deleted)", ""); err != nil {
+		return err
+	}
+	uidPlus, err := this.HasCapability("UIDPLUS")
+	if err != nil {
+		return err
+	} else if uidPlus {
+		_, err = this.cmd("UID EXPUNGE " + strings.Join(uids, ","), "")
+	} else {
+		_, err = this.cmd("EXPUNGE", "")
+	}
+	return err
+}
+
+func (this *imapSession) Logout() {
+	this.cmd("LOGOUT", "")
+}
+
+func imapQuote(str string) string {
+	str = strings.Replace(str, "\\", "\\\\", -1)
+	str = strings.Replace(str, "\"", "\\\"", -1)
+	return "\"" + str + "\""
+}
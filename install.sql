@@ -3,7 +3,7 @@ CREATE TABLE checks (
 	id INT NOT NULL PRIMARY KEY AUTO_INCREMENT,
 	name VARCHAR(64) NOT NULL,
 	type VARCHAR(16) NOT NULL,
-	data VARCHAR(1024) NOT NULL,
+	data TEXT NOT NULL,
 	check_interval INT NOT NULL DEFAULT 60,
 	delay INT NOT NULL DEFAULT 1,
 	status ENUM ('online', 'offline') DEFAULT 'online',
@@ -32,6 +32,14 @@ CREATE TABLE check_events (
 	time TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+CREATE TABLE heartbeats (
+	check_id INT NOT NULL PRIMARY KEY,
+	last_start INT NOT NULL DEFAULT 0,
+	last_success INT NOT NULL DEFAULT 0,
+	last_failure INT NOT NULL DEFAULT 0,
+	message VARCHAR(512) NOT NULL DEFAULT ''
+);
+
 CREATE TABLE charges (
 	id INT NOT NULL PRIMARY KEY AUTO_INCREMENT,
 	check_id INT NOT NULL,
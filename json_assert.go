@@ -0,0 +1,204 @@
+package gobearmon
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "reflect"
+import "strconv"
+import "strings"
+
+// JsonAssertion verifies a value in a JSON document.
+//
+// Path selects the value with dot-separated object keys and array indices,
+// e.g. "db", "services.0.status" or "services[0].status"; an empty path or "$"
+// selects the whole document. Op is one of:
+//  * equals, not_equals: compare against Value
+//  * less_than, greater_than: numeric comparison against Value
+//  * exists, not_exists: whether the path is present, Value is ignored
+//  * length, min_length, max_length: compare the length of an array, object or
+//    string against Value
+type JsonAssertion struct {
+	Path string `json:"path"`
+	Op string `json:"op"`
+	Value interface{} `json:"value"`
+
+	segments []interface{} // string keys and int indices, parsed from Path
+}
+
+func (this *JsonAssertion) String() string {
+	if this.Op == "exists" || this.Op == "not_exists" {
+		return fmt.Sprintf("%s %s", this.displayPath(), this.Op)
+	}
+	return fmt.Sprintf("%s %s %s", this.displayPath(), this.Op, jsonString(this.Value))
+}
+
+func (this *JsonAssertion) displayPath() string {
+	if this.Path == "" {
+		return "$"
+	}
+	return this.Path
+}
+
+// Validate checks the operator and value, and parses the path.
+func (this *JsonAssertion) Validate() error {
+	switch this.Op {
+	case "equals", "not_equals", "exists", "not_exists":
+	case "less_than", "greater_than", "length", "min_length", "max_length":
+		if _, ok := this.Value.(float64); !ok {
+			return fmt.Errorf("JSON assertion on %s: operator %s requires a numeric value", this.displayPath(), this.Op)
+		}
+	case "":
+		return fmt.Errorf("JSON assertion on %s: op is required", this.displayPath())
+	default:
+		return fmt.Errorf("JSON assertion on %s: unknown operator %s", this.displayPath(), this.Op)
+	}
+
+	segments, err := parseJsonPath(this.Path)
+	if err != nil {
+		return fmt.Errorf("JSON assertion: invalid path %s: %v", this.Path, err)
+	}
+	this.segments = segments
+	return nil
+}
+
+// Check evaluates the assertion against a decoded JSON document.
+func (this *JsonAssertion) Check(doc interface{}) error {
+	value, found := lookupJsonPath(doc, this.segments)
+	if this.Op == "exists" || this.Op == "not_exists" {
+		if found != (this.Op == "exists") {
+			return fmt.Errorf("JSON assertion failed: %s", this)
+		}
+		return nil
+	} else if !found {
+		return fmt.Errorf("JSON assertion failed: %s (path not found)", this)
+	}
+
+	var ok bool
+	switch this.Op {
+	case "equals":
+		ok = reflect.DeepEqual(value, this.Value)
+	case "not_equals":
+		ok = !reflect.DeepEqual(value, this.Value)
+	case "less_than", "greater_than":
+		number, isNumber := value.(float64)
+		if !isNumber {
+			return fmt.Errorf("JSON assertion failed: %s (got non-numeric %s)", this, jsonString(value))
+		}
+		if this.Op == "less_than" {
+			ok = number < this.Value.(float64)
+		} else {
+			ok = number > this.Value.(float64)
+		}
+	case "length", "min_length", "max_length":
+		var length int
+		switch v := value.(type) {
+		case []interface{}:
+			length = len(v)
+		case map[string]interface{}:
+			length = len(v)
+		case string:
+			length = len(v)
+		default:
+			return fmt.Errorf("JSON assertion failed: %s (got %s, which has no length)", this, jsonString(value))
+		}
+		expected := int(this.Value.(float64))
+		if this.Op == "length" {
+			ok = length == expected
+		} else if this.Op == "min_length" {
+			ok = length >= expected
+		} else {
+			ok = length <= expected
+		}
+		if !ok {
+			return fmt.Errorf("JSON assertion failed: %s (got length %d)", this, length)
+		}
+	}
+
+	if !ok {
+		return fmt.Errorf("JSON assertion failed: %s (got %s)", this, jsonString(value))
+	}
+	return nil
+}
+
+func parseJsonPath(path string) ([]interface{}, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return nil, nil
+	}
+
+	var segments []interface{}
+	for _, part := range strings.Split(path, ".") {
+		// split out bracketed indices, e.g. services[0][1]
+		key := part
+		var indices []string
+		if idx := strings.Index(part, "["); idx != -1 {
+			key = part[:idx]
+			rest := part[idx:]
+			for rest != "" {
+				end := strings.Index(rest, "]")
+				if rest[0] != '[' || end == -1 {
+					return nil, errors.New("unbalanced brackets")
+				}
+				indices = append(indices, rest[1:end])
+				rest = rest[end + 1:]
+			}
+		}
+
+		if key == "" && len(indices) == 0 {
+			return nil, errors.New("empty path segment")
+		} else if key != "" {
+			if i, err := strconv.Atoi(key); err == nil && i >= 0 {
+				segments = append(segments, i)
+			} else {
+				segments = append(segments, key)
+			}
+		}
+		for _, index := range indices {
+			i, err := strconv.Atoi(index)
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("invalid array index [%s]", index)
+			}
+			segments = append(segments, i)
+		}
+	}
+	return segments, nil
+}
+
+func lookupJsonPath(doc interface{}, segments []interface{}) (interface{}, bool) {
+	value := doc
+	for _, segment := range segments {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			// numeric segments may also be object keys
+			key, ok := segment.(string)
+			if !ok {
+				key = strconv.Itoa(segment.(int))
+			}
+			value, ok = v[key]
+			if !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, ok := segment.(int)
+			if !ok || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func jsonString(value interface{}) string {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	str := string(bytes)
+	if len(str) > 100 {
+		str = str[:100] + "..."
+	}
+	return str
+}
@@ -0,0 +1,178 @@
+package gobearmon
+
+import "context"
+import "crypto/rand"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "net"
+import "strings"
+import "time"
+
+// subject prefix of messages sent by the mail_roundtrip check
+const mailRoundtripSubject = "gobearmon roundtrip"
+
+// messages left behind by earlier runs, e.g. because delivery took longer than
+// max_delay, are deleted once they are older than any run can take; younger
+// ones may still be awaited by other workers
+const mailRoundtripCleanupAge = checkTimeout
+
+type mailRoundtripChecker struct{}
+
+func (this mailRoundtripChecker) Describe() string {
+	return "e-mail delivery from an SMTP server to an IMAP mailbox"
+}
+
+func (this mailRoundtripChecker) Parse(data string) (interface{}, error) {
+	var params MailRoundtripCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateAddress(params.SmtpAddress); err != nil {
+		return nil, fmt.Errorf("smtp_address: %v", err)
+	} else if err := validateAddress(params.ImapAddress); err != nil {
+		return nil, fmt.Errorf("imap_address: %v", err)
+	} else if params.From == "" || params.To == "" {
+		return nil, errors.New("from and to are required")
+	} else if strings.ContainsAny(params.From + params.To, "<>\r\n") {
+		return nil, errors.New("from and to must be plain addresses")
+	} else if params.ImapUsername == "" {
+		return nil, errors.New("imap_username is required")
+	} else if params.SmtpTls && params.SmtpStartTls || params.ImapTls && params.ImapStartTls {
+		return nil, errors.New("tls and starttls cannot both be set")
+	} else if !params.PlaintextAuth && params.SmtpUsername != "" && !params.SmtpTls && !params.SmtpStartTls {
+		return nil, errors.New("refusing to authenticate to the SMTP server without TLS, set plaintext_auth to allow")
+	} else if !params.PlaintextAuth && !params.ImapTls && !params.ImapStartTls {
+		return nil, errors.New("refusing to authenticate to the IMAP server without TLS, set plaintext_auth to allow")
+	} else if err := params.loadTls(); err != nil {
+		return nil, err
+	}
+
+	// fix parameters
+	params.Timeout = clampTimeout(params.Timeout)
+	if params.Mailbox == "" {
+		params.Mailbox = "INBOX"
+	}
+	if params.MaxDelay <= 0 {
+		params.MaxDelay = 30
+	}
+	if params.PollInterval <= 0 {
+		params.PollInterval = 5
+	}
+	if time.Duration(params.MaxDelay + 3 * params.Timeout) * time.Second > checkTimeout {
+		return nil, fmt.Errorf("max_delay plus three timeouts must be at most %v", checkTimeout)
+	}
+
+	return &params, nil
+}
+
+func (this mailRoundtripChecker) Run(ctx context.Context, p interface{}, result *CheckResult) error {
+	params := p.(*MailRoundtripCheckParams)
+	timeout := time.Duration(params.Timeout) * time.Second
+
+	// log in to IMAP first, so that we do not send messages that we cannot
+	//  retrieve and delete
+	imapHost, _, _ := net.SplitHostPort(params.ImapAddress)
+	imap, err := dialImap(ctx, params.ImapAddress, timeout, params.ImapTls, params.tlsConfig(imapHost))
+	if err != nil {
+		return fmt.Errorf("IMAP: %v", err)
+	}
+	defer imap.Close()
+	if err := imap.Greeting(); err != nil {
+		return fmt.Errorf("IMAP: %v", err)
+	} else if params.ImapStartTls {
+		if err := imap.StartTls(ctx, params.tlsConfig(imapHost)); err != nil {
+			return fmt.Errorf("IMAP: %v", err)
+		}
+	}
+	if err := imap.Login(params.ImapUsername, params.ImapPassword); err != nil {
+		return fmt.Errorf("IMAP: %v", err)
+	} else if err := imap.Select(params.Mailbox); err != nil {
+		return fmt.Errorf("IMAP: %v", err)
+	}
+	stale, err := imap.SearchSubjectBefore(mailRoundtripSubject, time.Now().Add(-mailRoundtripCleanupAge))
+	if err != nil {
+		return fmt.Errorf("IMAP: %v", err)
+	} else if len(stale) > 0 {
+		if err := imap.Delete(stale); err != nil {
+			return fmt.Errorf("IMAP: failed to delete old messages: %v", err)
+		}
+	}
+
+	token := make([]byte, 12)
+	rand.Read(token)
+	subject := mailRoundtripSubject + " " + hex.EncodeToString(token)
+	start := time.Now()
+	if err := this.send(ctx, params, subject); err != nil {
+		return fmt.Errorf("SMTP: %v", err)
+	}
+
+	deadline := start.Add(time.Duration(params.MaxDelay) * time.Second)
+	for {
+		uids, err := imap.SearchSubject(subject)
+		if err != nil {
+			return fmt.Errorf("IMAP: %v", err)
+		} else if len(uids) > 0 {
+			result.Duration = time.Since(start)
+			if err := imap.Delete(uids); err != nil {
+				return fmt.Errorf("IMAP: failed to delete message: %v", err)
+			}
+			imap.Logout()
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("message was not delivered to %s within %d seconds", params.Mailbox, params.MaxDelay)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(params.PollInterval) * time.Second):
+		}
+	}
+}
+
+func (this mailRoundtripChecker) send(ctx context.Context, params *MailRoundtripCheckParams, subject string) error {
+	host, _, _ := net.SplitHostPort(params.SmtpAddress)
+	tlsConfig := params.tlsConfig(host)
+	session, err := dialSmtp(ctx, params.SmtpAddress, time.Duration(params.Timeout) * time.Second, params.SmtpTls, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if _, err := session.Banner(); err != nil {
+		return err
+	} else if err := session.Ehlo("gobearmon"); err != nil {
+		return err
+	}
+	if params.SmtpStartTls {
+		if _, err := session.StartTls(ctx, tlsConfig); err != nil {
+			return err
+		} else if err := session.Ehlo("gobearmon"); err != nil {
+			return err
+		}
+	}
+	if params.SmtpUsername != "" {
+		if err := session.Auth("plain", params.SmtpUsername, params.SmtpPassword); err != nil {
+			return err
+		}
+	}
+
+	message := strings.Join([]string{
+		"From: " + params.From,
+		"To: " + params.To,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: <" + strings.Replace(subject, " ", ".", -1) + "@gobearmon>",
+		"",
+		"This message was sent by gobearmon to verify e-mail delivery, and will be deleted automatically.",
+	}, "\r\n")
+	if err := session.SendMail(params.From, params.To, message); err != nil {
+		return err
+	}
+	session.Quit()
+	return nil
+}
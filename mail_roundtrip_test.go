@@ -0,0 +1,249 @@
+package gobearmon
+
+import "bufio"
+import "fmt"
+import "net"
+import "strconv"
+import "strings"
+import "sync"
+import "testing"
+import "time"
+
+type fakeMessage struct {
+	uid int
+	subject string
+	date time.Time
+	deleted bool
+}
+
+// fakeMailbox is shared by a fake SMTP server, which delivers accepted
+// messages after a delay, and a fake IMAP server.
+type fakeMailbox struct {
+	mu sync.Mutex
+	messages []*fakeMessage
+	nextUid int
+	delay time.Duration
+	uidPlus bool
+}
+
+func (this *fakeMailbox) add(subject string, date time.Time) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.nextUid++
+	this.messages = append(this.messages, &fakeMessage{uid: this.nextUid, subject: subject, date: date})
+}
+
+func (this *fakeMailbox) subjects() []string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var subjects []string
+	for _, message := range this.messages {
+		subjects = append(subjects, message.subject)
+	}
+	return subjects
+}
+
+func (this *fakeMailbox) countPrefix(prefix string) int {
+	var count int
+	for _, subject := range this.subjects() {
+		if strings.HasPrefix(subject, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func fakeListen(t *testing.T, handle func(conn net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (this *fakeMailbox) serveSmtp(conn net.Conn) {
+	in := bufio.NewReader(conn)
+	writeLine(conn, "220 fake ESMTP")
+	for {
+		line, err := readLine(in)
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch command {
+		case "EHLO":
+			writeLine(conn, "250-fake")
+			writeLine(conn, "250 8BITMIME")
+		case "MAIL", "RCPT":
+			writeLine(conn, "250 OK")
+		case "DATA":
+			writeLine(conn, "354 go ahead")
+			var subject string
+			for {
+				line, err := readLine(in)
+				if err != nil {
+					return
+				} else if line == "." {
+					break
+				} else if strings.HasPrefix(line, "Subject: ") {
+					subject = strings.TrimPrefix(line, "Subject: ")
+				}
+			}
+			time.AfterFunc(this.delay, func() {
+				this.add(subject, time.Now())
+			})
+			writeLine(conn, "250 queued")
+		case "QUIT":
+			writeLine(conn, "221 bye")
+			return
+		default:
+			writeLine(conn, "502 unknown command")
+		}
+	}
+}
+
+func (this *fakeMailbox) serveImap(conn net.Conn) {
+	in := bufio.NewReader(conn)
+	writeLine(conn, "* OK fake IMAP")
+	for {
+		line, err := readLine(in)
+		if err != nil {
+			return
+		}
+		parts := strings.SplitN(line, " ", 2)
+		tag, command := parts[0], parts[1]
+		this.mu.Lock()
+		switch {
+		case strings.HasPrefix(command, "UID SEARCH SUBJECT "):
+			subject, _ := strconv.Unquote(strings.TrimPrefix(command, "UID SEARCH SUBJECT "))
+			response := "* SEARCH"
+			for _, message := range this.messages {
+				if strings.Contains(message.subject, subject) {
+					response += " " + strconv.Itoa(message.uid)
+				}
+			}
+			writeLine(conn, response)
+		case strings.HasPrefix(command, "UID FETCH "):
+			uids := strings.Split(strings.Fields(command)[2], ",")
+			for i, message := range this.messages {
+				for _, uid := range uids {
+					if uid == strconv.Itoa(message.uid) {
+						writeLine(conn, fmt.Sprintf("* %d FETCH (INTERNALDATE \"%s\" UID %d)", i + 1, message.date.Format("_2-Jan-2006 15:04:05 -0700"), message.uid))
+					}
+				}
+			}
+		case strings.HasPrefix(command, "UID STORE "):
+			uids := strings.Split(strings.Fields(command)[2], ",")
+			for _, message := range this.messages {
+				for _, uid := range uids {
+					message.deleted = message.deleted || uid == strconv.Itoa(message.uid)
+				}
+			}
+		case command == "CAPABILITY":
+			if this.uidPlus {
+				writeLine(conn, "* CAPABILITY IMAP4rev1 UIDPLUS")
+			} else {
+				writeLine(conn, "* CAPABILITY IMAP4rev1")
+			}
+		case command == "EXPUNGE" || strings.HasPrefix(command, "UID EXPUNGE ") && this.uidPlus:
+			var uids []string
+			if command != "EXPUNGE" {
+				uids = strings.Split(strings.Fields(command)[2], ",")
+			}
+			var kept []*fakeMessage
+			for _, message := range this.messages {
+				var listed bool
+				for _, uid := range uids {
+					listed = listed || uid == strconv.Itoa(message.uid)
+				}
+				if !message.deleted || uids != nil && !listed {
+					kept = append(kept, message)
+				}
+			}
+			this.messages = kept
+		}
+		this.mu.Unlock()
+		if strings.HasPrefix(command, "UID EXPUNGE ") && !this.uidPlus {
+			writeLine(conn, tag + " BAD unknown command")
+			continue
+		}
+		writeLine(conn, tag + " OK done")
+		if command == "LOGOUT" {
+			return
+		}
+	}
+}
+
+func runFakeRoundtrip(t *testing.T, mailbox *fakeMailbox) *CheckResult {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	smtpAddress := fakeListen(t, mailbox.serveSmtp)
+	imapAddress := fakeListen(t, mailbox.serveImap)
+	data := fmt.Sprintf(`{"smtp_address":"%s","imap_address":"%s","from":"monitor@example.com","to":"inbox@example.com","imap_username":"inbox","imap_password":"secret","plaintext_auth":true,"max_delay":1,"poll_interval":1,"timeout":3}`, smtpAddress, imapAddress)
+	params, err := ParseCheck("mail_roundtrip", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DoCheck(&Check{Name: "roundtrip", Type: "mail_roundtrip", Data: data, Params: params})
+}
+
+func TestMailRoundtripDelivered(t *testing.T) {
+	mailbox := &fakeMailbox{}
+	result := runFakeRoundtrip(t, mailbox)
+	if result.Status != StatusOnline {
+		t.Fatalf("expected online, got %s: %s", result.Status, result.Message)
+	} else if n := mailbox.countPrefix(mailRoundtripSubject); n != 0 {
+		t.Fatalf("expected the message to be deleted, %d remain", n)
+	}
+}
+
+func TestMailRoundtripLate(t *testing.T) {
+	mailbox := &fakeMailbox{delay: 2500 * time.Millisecond}
+	result := runFakeRoundtrip(t, mailbox)
+	if result.Status != StatusOffline || !strings.Contains(result.Message, "not delivered") {
+		t.Fatalf("expected offline due to late delivery, got %s: %s", result.Status, result.Message)
+	}
+}
+
+func TestMailRoundtripDeletesOldMessages(t *testing.T) {
+	mailbox := &fakeMailbox{}
+	mailbox.add(mailRoundtripSubject + " stale", time.Now().Add(-time.Hour))
+	mailbox.add(mailRoundtripSubject + " in flight", time.Now())
+	mailbox.add("unrelated", time.Now().Add(-time.Hour))
+
+	result := runFakeRoundtrip(t, mailbox)
+	if result.Status != StatusOnline {
+		t.Fatalf("expected online, got %s: %s", result.Status, result.Message)
+	}
+	subjects := strings.Join(mailbox.subjects(), ", ")
+	if subjects != mailRoundtripSubject + " in flight, unrelated" {
+		t.Fatalf("unexpected remaining messages: %s", subjects)
+	}
+}
+
+func TestMailRoundtripKeepsOtherDeletedMessages(t *testing.T) {
+	mailbox := &fakeMailbox{uidPlus: true}
+	mailbox.add("flagged by a user", time.Now())
+	mailbox.messages[0].deleted = true
+
+	result := runFakeRoundtrip(t, mailbox)
+	if result.Status != StatusOnline {
+		t.Fatalf("expected online, got %s: %s", result.Status, result.Message)
+	} else if subjects := strings.Join(mailbox.subjects(), ", "); subjects != "flagged by a user" {
+		t.Fatalf("unexpected remaining messages: %s", subjects)
+	}
+}
@@ -0,0 +1,95 @@
+package gobearmon
+
+import "fmt"
+import "regexp"
+import "strings"
+
+// length of received data to include in failure messages
+const snippetLength = 120
+
+// MatchParams can be embedded in check parameters to verify received data
+// against several patterns. Every expected pattern must match, and no rejected
+// pattern may match.
+type MatchParams struct {
+	ExpectSubstrings []string `json:"expect_substrings"`
+	ExpectRegex []string `json:"expect_regex"`
+	RejectSubstrings []string `json:"reject_substrings"` // e.g. a maintenance page served with status 200
+	RejectRegex []string `json:"reject_regex"`
+
+	expectRegex []*regexp.Regexp
+	rejectRegex []*regexp.Regexp
+}
+
+// compile validates and compiles the regular expressions; it must be called
+// from the check type's Parse.
+func (this *MatchParams) compile() error {
+	this.expectRegex = nil
+	this.rejectRegex = nil
+	for _, expr := range this.ExpectRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid expect_regex [%s]: %v", expr, err)
+		}
+		this.expectRegex = append(this.expectRegex, re)
+	}
+	for _, expr := range this.RejectRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid reject_regex [%s]: %v", expr, err)
+		}
+		this.rejectRegex = append(this.rejectRegex, re)
+	}
+	return nil
+}
+
+func (this *MatchParams) active() bool {
+	return len(this.ExpectSubstrings) > 0 || len(this.expectRegex) > 0 || len(this.RejectSubstrings) > 0 || len(this.rejectRegex) > 0
+}
+
+// match returns an error naming the first pattern that is not satisfied by
+// data, along with a snippet of data.
+func (this *MatchParams) match(data string, what string) error {
+	for _, substring := range this.ExpectSubstrings {
+		if !strings.Contains(data, substring) {
+			return fmt.Errorf("expected substring [%s] was not found in the %s (received [%s])", substring, what, snippet(data, 0))
+		}
+	}
+	for _, re := range this.expectRegex {
+		if !re.MatchString(data) {
+			return fmt.Errorf("expected pattern /%s/ did not match the %s (received [%s])", re, what, snippet(data, 0))
+		}
+	}
+	for _, substring := range this.RejectSubstrings {
+		if idx := strings.Index(data, substring); idx != -1 {
+			return fmt.Errorf("rejected substring [%s] was found in the %s (received [%s])", substring, what, snippet(data, idx))
+		}
+	}
+	for _, re := range this.rejectRegex {
+		if loc := re.FindStringIndex(data); loc != nil {
+			return fmt.Errorf("rejected pattern /%s/ matched the %s (received [%s])", re, what, snippet(data, loc[0]))
+		}
+	}
+	return nil
+}
+
+// snippet returns a short excerpt of data around the given offset, with
+// whitespace collapsed so that it fits on a single line.
+func snippet(data string, start int) string {
+	from := start - snippetLength / 2
+	if from < 0 {
+		from = 0
+	}
+	to := from + snippetLength
+	if to > len(data) {
+		to = len(data)
+	}
+
+	str := strings.Join(strings.Fields(strings.ToValidUTF8(data[from:to], "")), " ")
+	if from > 0 {
+		str = "..." + str
+	}
+	if to < len(data) {
+		str += "..."
+	}
+	return str
+}
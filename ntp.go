@@ -0,0 +1,164 @@
+package gobearmon
+
+import "context"
+import "crypto/rand"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "net"
+import "strconv"
+import "strings"
+import "time"
+
+// seconds between the NTP epoch (1900) and the Unix epoch
+const ntpEpochOffset = 2208988800
+
+// leap indicator value meaning the server clock is not synchronised
+const ntpLeapAlarm = 3
+
+type ntpResponse struct {
+	Leap int
+	Stratum int
+	ReferenceId string
+	Offset time.Duration // server clock minus local clock
+	Delay time.Duration // round-trip delay, excluding server processing
+}
+
+func ntpTime(data []byte) time.Time {
+	seconds := binary.BigEndian.Uint32(data[0:4])
+	fraction := binary.BigEndian.Uint32(data[4:8])
+	nanos := (int64(fraction) * 1e9) >> 32
+	return time.Unix(int64(seconds) - ntpEpochOffset, nanos)
+}
+
+// ntpQuery sends a client mode request to the server. The transmit timestamp
+// of the request is random and only used to match the response, so that the
+// offset does not depend on the resolution of the local clock.
+func ntpQuery(conn net.Conn, timeout time.Duration) (*ntpResponse, error) {
+	request := make([]byte, 48)
+	request[0] = 4 << 3 | 3 // version 4, client mode
+	rand.Read(request[40:48])
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	sent := time.Now()
+	_, err := conn.Write(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	response := make([]byte, 512)
+	var n int
+	for {
+		n, err = conn.Read(response)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response: %v", err)
+		} else if n >= 48 && string(response[24:32]) == string(request[40:48]) {
+			break
+		}
+		// ignore short or stale responses
+	}
+	received := sent.Add(time.Since(sent))
+
+	if mode := response[0] & 7; mode != 4 {
+		return nil, fmt.Errorf("unexpected mode %d in response", mode)
+	}
+	result := &ntpResponse{
+		Leap: int(response[0] >> 6),
+		Stratum: int(response[1]),
+	}
+	if result.Stratum == 0 {
+		// kiss-o'-death packet, the reference id holds an ASCII code
+		return nil, fmt.Errorf("server sent kiss code %s", strings.TrimRight(string(response[12:16]), "\x00"))
+	} else if result.Stratum == 1 {
+		result.ReferenceId = strings.TrimRight(string(response[12:16]), "\x00")
+	} else {
+		result.ReferenceId = net.IP(response[12:16]).String()
+	}
+
+	serverReceived := ntpTime(response[32:40])
+	serverSent := ntpTime(response[40:48])
+	if binary.BigEndian.Uint64(response[40:48]) == 0 {
+		return nil, errors.New("response has no transmit timestamp")
+	}
+	result.Offset = (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2
+	result.Delay = received.Sub(sent) - serverSent.Sub(serverReceived)
+	if result.Delay < 0 {
+		result.Delay = 0
+	}
+	return result, nil
+}
+
+type ntpChecker struct{}
+
+func (this ntpChecker) Describe() string {
+	return "NTP server synchronisation, stratum and clock offset"
+}
+
+func (this ntpChecker) Parse(data string) (interface{}, error) {
+	var params NtpCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	params.Address = withDefaultPort(params.Address, "123")
+	if err := validateAddress(params.Address); err != nil {
+		return nil, err
+	} else if err := validateForceIP(params.ForceIP); err != nil {
+		return nil, err
+	} else if params.MaxStratum < 0 || params.MaxStratum > 15 {
+		return nil, fmt.Errorf("max_stratum must be between 1 and 15, got %d", params.MaxStratum)
+	} else if params.MaxOffset < 0 {
+		return nil, errors.New("max_offset must be non-negative")
+	}
+
+	// fix parameters
+	params.Timeout = clampTimeout(params.Timeout)
+	if params.MaxStratum == 0 {
+		params.MaxStratum = 15
+	}
+	return &params, nil
+}
+
+func (this ntpChecker) Run(ctx context.Context, p interface{}, result *CheckResult) error {
+	params := p.(*NtpCheckParams)
+	timeout := time.Duration(params.Timeout) * time.Second
+
+	network := "udp"
+	if params.ForceIP == 4 {
+		network = "udp4"
+	} else if params.ForceIP == 6 {
+		network = "udp6"
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, params.Address)
+	if err != nil {
+		return fmt.Errorf("UDP connection error: %v", err)
+	}
+	defer conn.Close()
+
+	response, err := ntpQuery(conn, timeout)
+	if err != nil {
+		return err
+	}
+	result.Duration = response.Delay
+	result.Details = map[string]string{
+		"stratum": strconv.Itoa(response.Stratum),
+		"reference_id": response.ReferenceId,
+		"offset": roundDuration(response.Offset).String(),
+	}
+
+	absOffset := response.Offset
+	if absOffset < 0 {
+		absOffset = -absOffset
+	}
+	if response.Leap == ntpLeapAlarm {
+		return errors.New("server clock is not synchronised (leap indicator alarm)")
+	} else if response.Stratum > params.MaxStratum {
+		return fmt.Errorf("stratum %d exceeds maximum of %d", response.Stratum, params.MaxStratum)
+	} else if params.MaxOffset > 0 && absOffset > time.Duration(params.MaxOffset) * time.Millisecond {
+		return fmt.Errorf("clock offset %v exceeds %dms", roundDuration(response.Offset), params.MaxOffset)
+	}
+	return nil
+}
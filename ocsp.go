@@ -0,0 +1,92 @@
+package gobearmon
+
+import "bytes"
+import "context"
+import "crypto/x509"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "time"
+
+import "golang.org/x/crypto/ocsp"
+
+// names of ocsp.Response.RevocationReason values
+var ocspRevocationReasons = map[int]string{
+	ocsp.Unspecified: "unspecified",
+	ocsp.KeyCompromise: "key compromise",
+	ocsp.CACompromise: "CA compromise",
+	ocsp.AffiliationChanged: "affiliation changed",
+	ocsp.Superseded: "superseded",
+	ocsp.CessationOfOperation: "cessation of operation",
+	ocsp.CertificateHold: "certificate hold",
+	ocsp.RemoveFromCRL: "remove from CRL",
+	ocsp.PrivilegeWithdrawn: "privilege withdrawn",
+	ocsp.AACompromise: "AA compromise",
+}
+
+// ocspStatus verifies the revocation status of the certificate, using the
+// stapled response if there is one and otherwise querying the responder
+// named in the certificate. It returns where the status came from: stapled,
+// responder, or unavailable if the certificate names no responder.
+func ocspStatus(ctx context.Context, cert *x509.Certificate, issuer *x509.Certificate, stapled []byte, timeout time.Duration) (string, error) {
+	source := "stapled"
+	raw := stapled
+	if len(raw) == 0 {
+		if len(cert.OCSPServer) == 0 {
+			return "unavailable", nil
+		}
+		source = "responder"
+		var err error
+		raw, err = ocspQuery(ctx, cert.OCSPServer[0], cert, issuer, timeout)
+		if err != nil {
+			return source, fmt.Errorf("OCSP request to %s failed: %v", cert.OCSPServer[0], err)
+		}
+	}
+
+	response, err := ocsp.ParseResponseForCert(raw, cert, issuer)
+	if err != nil {
+		return source, fmt.Errorf("invalid %s OCSP response: %v", source, err)
+	} else if !response.NextUpdate.IsZero() && time.Now().After(response.NextUpdate) {
+		return source, fmt.Errorf("%s OCSP response expired at %s", source, response.NextUpdate.Format(time.RFC3339))
+	}
+
+	switch response.Status {
+	case ocsp.Good:
+		return source, nil
+	case ocsp.Revoked:
+		return source, fmt.Errorf("certificate (%s) was revoked at %s (%s)", cert.Subject.CommonName, response.RevokedAt.Format(time.RFC3339), ocspRevocationReasons[response.RevocationReason])
+	default:
+		return source, fmt.Errorf("OCSP status of certificate (%s) is unknown", cert.Subject.CommonName)
+	}
+}
+
+func ocspQuery(ctx context.Context, server string, cert *x509.Certificate, issuer *x509.Certificate, timeout time.Duration) ([]byte, error) {
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, "POST", server, bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/ocsp-request")
+
+	client := http.Client{Timeout: timeout}
+	response, err := client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("responder returned HTTP status %d", response.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 1024 * 1024))
+	if err != nil {
+		return nil, err
+	} else if len(body) == 0 {
+		return nil, errors.New("empty response")
+	}
+	return body, nil
+}
@@ -15,9 +15,24 @@ const (
 	StatusFail = "fail"
 )
 
+// keys of CheckResult.Timings
+const (
+	TimingDNS = "dns"
+	TimingConnect = "connect"
+	TimingTLS = "tls"
+	TimingFirstByte = "ttfb"
+	TimingRttMin = "rtt_min"
+	TimingRttAvg = "rtt_avg"
+	TimingRttMax = "rtt_max"
+	TimingJitter = "jitter"
+)
+
 type CheckResult struct {
 	Status CheckStatus `json:"status"`
 	Message string `json:"message"`
+	Duration time.Duration `json:"duration"` // response time
+	Timings map[string]time.Duration `json:"timings,omitempty"` // detailed timings, e.g. HTTP request phases
+	Details map[string]string `json:"details,omitempty"` // additional check-specific information
 }
 
 type ControllerRequest struct {
@@ -40,6 +55,7 @@ type Check struct {
 	Name string
 	Type string
 	Data string
+	Params interface{} // parsed from Data by the check type's Checker
 	Interval int
 	Delay int
 	Status CheckStatus
@@ -0,0 +1,217 @@
+package gobearmon
+
+import "context"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "net/http"
+import "net/url"
+import "strings"
+import "sync"
+import "time"
+
+const rdapDefaultBootstrapUrl = "https://data.iana.org/rdap/dns.json"
+
+// how long a bootstrap registry is cached; IANA updates it rarely
+const rdapBootstrapTtl = 24 * time.Hour
+
+// maximum size of an RDAP or bootstrap response
+const maxRdapResponseBytes = 4 * 1024 * 1024
+
+// statuses that make a domain unreachable or about to be lost; they are
+// compared with normalizeRdapStatus, so the EPP form clientHold also works
+var rdapDefaultForbiddenStatuses = []string{"client hold", "server hold", "redemption period", "pending delete"}
+
+type rdapBootstrap struct {
+	Services [][][]string `json:"services"` // pairs of TLD and URL lists
+	fetched time.Time
+}
+
+var rdapBootstrapCache = make(map[string]*rdapBootstrap)
+var rdapBootstrapMu sync.Mutex
+
+type rdapDomain struct {
+	LdhName string `json:"ldhName"`
+	Status []string `json:"status"`
+	Events []struct {
+		Action string `json:"eventAction"`
+		Date string `json:"eventDate"`
+	} `json:"events"`
+}
+
+// normalizeRdapStatus makes RDAP statuses such as "client hold" comparable to
+// the EPP form clientHold.
+func normalizeRdapStatus(status string) string {
+	return strings.ToLower(strings.Replace(status, " ", "", -1))
+}
+
+func rdapGet(ctx context.Context, client *http.Client, url string, target interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/rdap+json, application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == 404 {
+		return errors.New("not found")
+	} else if response.StatusCode != 200 {
+		return fmt.Errorf("server returned HTTP status %d", response.StatusCode)
+	}
+	err = json.NewDecoder(io.LimitReader(response.Body, maxRdapResponseBytes)).Decode(target)
+	if err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	return nil
+}
+
+// rdapServer finds the RDAP base URL for the domain in the bootstrap
+// registry, preferring the longest matching suffix and https URLs.
+func rdapServer(ctx context.Context, client *http.Client, bootstrapUrl string, domain string) (string, error) {
+	rdapBootstrapMu.Lock()
+	bootstrap := rdapBootstrapCache[bootstrapUrl]
+	rdapBootstrapMu.Unlock()
+	if bootstrap == nil || time.Since(bootstrap.fetched) > rdapBootstrapTtl {
+		bootstrap = &rdapBootstrap{}
+		err := rdapGet(ctx, client, bootstrapUrl, bootstrap)
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch RDAP bootstrap registry: %v", err)
+		}
+		bootstrap.fetched = time.Now()
+		rdapBootstrapMu.Lock()
+		rdapBootstrapCache[bootstrapUrl] = bootstrap
+		rdapBootstrapMu.Unlock()
+	}
+
+	var best string
+	var bestLength int
+	for _, service := range bootstrap.Services {
+		if len(service) != 2 || len(service[1]) == 0 {
+			continue
+		}
+		for _, suffix := range service[0] {
+			suffix = strings.ToLower(suffix)
+			if (domain == suffix || strings.HasSuffix(domain, "." + suffix)) && len(suffix) > bestLength {
+				best = service[1][0]
+				for _, u := range service[1] {
+					if strings.HasPrefix(u, "https://") {
+						best = u
+						break
+					}
+				}
+				bestLength = len(suffix)
+			}
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no RDAP server is known for %s", domain)
+	}
+	return best, nil
+}
+
+type domainExpireChecker struct{}
+
+func (this domainExpireChecker) Describe() string {
+	return "domain registration expiration and status, using RDAP"
+}
+
+func (this domainExpireChecker) Parse(data string) (interface{}, error) {
+	var params DomainExpireCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	params.Domain = strings.ToLower(strings.TrimSuffix(params.Domain, "."))
+	if params.Domain == "" {
+		return nil, errors.New("domain is required")
+	} else if !strings.Contains(params.Domain, ".") {
+		return nil, fmt.Errorf("invalid domain %s", params.Domain)
+	} else if params.Days < 0 {
+		return nil, fmt.Errorf("days must be non-negative, got %d", params.Days)
+	}
+	for _, str := range []string{params.BootstrapUrl, params.Server} {
+		if str == "" {
+			continue
+		}
+		u, err := url.Parse(str)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL %s", str)
+		}
+	}
+
+	// fix parameters
+	params.Timeout = clampTimeout(params.Timeout)
+	if params.BootstrapUrl == "" {
+		params.BootstrapUrl = rdapDefaultBootstrapUrl
+	}
+	if params.ForbiddenStatuses == nil {
+		params.ForbiddenStatuses = rdapDefaultForbiddenStatuses
+	}
+	return &params, nil
+}
+
+func (this domainExpireChecker) Run(ctx context.Context, p interface{}, result *CheckResult) error {
+	params := p.(*DomainExpireCheckParams)
+	client := &http.Client{Timeout: time.Duration(params.Timeout) * time.Second}
+
+	server := params.Server
+	if server == "" {
+		var err error
+		server, err = rdapServer(ctx, client, params.BootstrapUrl, params.Domain)
+		if err != nil {
+			return err
+		}
+	}
+	if !strings.HasSuffix(server, "/") {
+		server += "/"
+	}
+
+	var domain rdapDomain
+	err := rdapGet(ctx, client, server + "domain/" + url.PathEscape(params.Domain), &domain)
+	if err != nil {
+		return fmt.Errorf("RDAP lookup of %s failed: %v", params.Domain, err)
+	}
+
+	var expires time.Time
+	for _, event := range domain.Events {
+		if event.Action != "expiration" {
+			continue
+		}
+		// some servers omit the time zone, which is then UTC
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, event.Date); err == nil {
+				expires = t
+				break
+			}
+		}
+		if expires.IsZero() {
+			return fmt.Errorf("invalid expiration date %s", event.Date)
+		}
+	}
+	result.Details = map[string]string{"status": strings.Join(domain.Status, ", ")}
+	if !expires.IsZero() {
+		result.Details["expires"] = expires.UTC().Format(time.RFC3339)
+	}
+
+	for _, status := range domain.Status {
+		for _, forbidden := range params.ForbiddenStatuses {
+			if normalizeRdapStatus(status) == normalizeRdapStatus(forbidden) {
+				return fmt.Errorf("domain %s has status %s", params.Domain, status)
+			}
+		}
+	}
+
+	if expires.IsZero() {
+		return fmt.Errorf("RDAP response for %s has no expiration date", params.Domain)
+	}
+	daysRemaining := int(expires.Sub(time.Now()).Hours() / 24)
+	if daysRemaining <= params.Days {
+		return fmt.Errorf("domain %s expires in %d days", params.Domain, daysRemaining)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package gobearmon
+
+import "context"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "testing"
+import "time"
+
+// fakeRdap serves a bootstrap registry and domain responses; domains maps
+// names to their JSON responses.
+func fakeRdap(t *testing.T, domains map[string]string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/bootstrap.json":
+			fmt.Fprintf(w, `{"services":[
+				[["com"], ["http://com.invalid/rdap/"]],
+				[["example.com"], ["%s/registry/"]]
+			]}`, server.URL)
+		case strings.HasPrefix(r.URL.Path, "/registry/domain/"):
+			response, ok := domains[strings.TrimPrefix(r.URL.Path, "/registry/domain/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/rdap+json")
+			fmt.Fprint(w, response)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRdapServer(t *testing.T) {
+	server := fakeRdap(t, nil)
+	client := &http.Client{Timeout: 5 * time.Second}
+	bootstrapUrl := server.URL + "/bootstrap.json"
+
+	best, err := rdapServer(context.Background(), client, bootstrapUrl, "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	} else if best != server.URL + "/registry/" {
+		t.Fatalf("expected the URL of the longest suffix, got %s", best)
+	}
+	best, err = rdapServer(context.Background(), client, bootstrapUrl, "example.org")
+	if err == nil {
+		t.Fatalf("expected no server for example.org, got %s", best)
+	}
+
+	// https URLs are preferred, whatever their position
+	rdapBootstrapMu.Lock()
+	rdapBootstrapCache[bootstrapUrl].Services = [][][]string{
+		{{"net"}, {"http://net.invalid/", "https://net.invalid/"}},
+		{{"example.net"}, {"http://example.invalid/", "https://example.invalid/"}},
+	}
+	rdapBootstrapMu.Unlock()
+	best, err = rdapServer(context.Background(), client, bootstrapUrl, "a.example.net")
+	if err != nil {
+		t.Fatal(err)
+	} else if best != "https://example.invalid/" {
+		t.Fatalf("expected the https URL of the longest suffix, got %s", best)
+	}
+	best, err = rdapServer(context.Background(), client, bootstrapUrl, "notexample.net")
+	if err != nil {
+		t.Fatal(err)
+	} else if best != "https://net.invalid/" {
+		t.Fatalf("expected the https URL for net, got %s", best)
+	}
+}
+
+func TestDomainExpireCheck(t *testing.T) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	expires := time.Now().Add(100 * 24 * time.Hour).UTC()
+	server := fakeRdap(t, map[string]string{
+		"ok.example.com": fmt.Sprintf(`{"ldhName":"ok.example.com","status":["active"],"events":[{"eventAction":"registration","eventDate":"2001-01-01T00:00:00Z"},{"eventAction":"expiration","eventDate":"%s"}]}`, expires.Format("2006-01-02T15:04:05")),
+		"soon.example.com": fmt.Sprintf(`{"status":["active"],"events":[{"eventAction":"expiration","eventDate":"%s"}]}`, time.Now().Add(5 * 24 * time.Hour).Format(time.RFC3339)),
+		"hold.example.com": fmt.Sprintf(`{"status":["client hold"],"events":[{"eventAction":"expiration","eventDate":"%s"}]}`, expires.Format(time.RFC3339)),
+		"bad.example.com": `{"status":["active"],"events":[{"eventAction":"expiration","eventDate":"next year"}]}`,
+	})
+
+	tests := []struct {
+		domain string
+		extra string
+		message string // expected substring of the failure, or empty if online
+	}{
+		{"ok.example.com", "", ""},
+		{"ok.example.com", `,"server":"` + server.URL + `/registry"`, ""},
+		{"soon.example.com", "", "expires in 4 days"},
+		{"hold.example.com", "", "has status client hold"},
+		{"hold.example.com", `,"forbidden_statuses":["clientHold"]`, "has status client hold"},
+		{"hold.example.com", `,"forbidden_statuses":["pendingDelete"]`, ""},
+		{"bad.example.com", "", "invalid expiration date"},
+		{"missing.example.com", "", "not found"},
+	}
+	for _, test := range tests {
+		data := fmt.Sprintf(`{"domain":"%s","days":10,"bootstrap_url":"%s/bootstrap.json"%s}`, test.domain, server.URL, test.extra)
+		params, err := ParseCheck("domain_expire", data)
+		if err != nil {
+			t.Fatalf("%s: %v", test.domain, err)
+		}
+		result := DoCheck(&Check{Name: test.domain, Type: "domain_expire", Data: data, Params: params})
+		if test.message == "" && result.Status != StatusOnline {
+			t.Errorf("%s: expected online, got %s", test.domain, result.Message)
+		} else if test.message != "" && (result.Status != StatusOffline || !strings.Contains(result.Message, test.message)) {
+			t.Errorf("%s: expected failure with %q, got %s: %s", test.domain, test.message, result.Status, result.Message)
+		}
+		if test.domain == "ok.example.com" && result.Details["expires"] != expires.Format(time.RFC3339) {
+			t.Errorf("expected expiration %s without time zone to be read as UTC, got %s", expires.Format(time.RFC3339), result.Details["expires"])
+		}
+	}
+}
+
+func TestNormalizeRdapStatus(t *testing.T) {
+	if normalizeRdapStatus("client hold") != normalizeRdapStatus("clientHold") {
+		t.Error("client hold and clientHold should be equal")
+	} else if normalizeRdapStatus("client hold") == normalizeRdapStatus("server hold") {
+		t.Error("client hold and server hold should differ")
+	}
+}
@@ -0,0 +1,203 @@
+package gobearmon
+
+import "bufio"
+import "context"
+import "crypto/tls"
+import "errors"
+import "fmt"
+import "io"
+import "net"
+import "strconv"
+import "strings"
+import "time"
+
+// maximum size of a redis bulk reply that we read
+const maxRedisBulkLength = 1024 * 1024
+
+// maximum number of elements and nesting depth of an array reply; the bulk
+// replies in an array share a budget of maxRedisBulkLength bytes
+const maxRedisArrayLength = 4096
+const maxRedisArrayDepth = 8
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (this redisError) Error() string {
+	return string(this)
+}
+
+// redisCommand sends a command and reads the reply. Nil replies are returned
+// with isNull set, and arrays are flattened to one element per line.
+func redisCommand(conn net.Conn, in *bufio.Reader, args ...string) (reply string, isNull bool, err error) {
+	request := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		request += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	_, err = conn.Write([]byte(request))
+	if err != nil {
+		return "", false, err
+	}
+	return readRedisReply(in)
+}
+
+func readRedisReply(in *bufio.Reader) (string, bool, error) {
+	remaining := maxRedisBulkLength
+	return readRedisValue(in, 0, &remaining)
+}
+
+// readRedisValue reads a reply nested at the given depth; remaining is the
+// number of bulk bytes that may still be read.
+func readRedisValue(in *bufio.Reader, depth int, remaining *int) (string, bool, error) {
+	line, err := readLine(in)
+	if err != nil {
+		return "", false, err
+	} else if line == "" {
+		return "", false, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], false, nil
+	case '-':
+		return "", false, redisError(line[1:])
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", false, fmt.Errorf("invalid bulk length [%s]", line)
+		} else if length < 0 {
+			return "", true, nil
+		} else if length > *remaining {
+			return "", false, fmt.Errorf("bulk reply of %d bytes is too long", length)
+		}
+		*remaining -= length
+		data := make([]byte, length + 2)
+		_, err = io.ReadFull(in, data)
+		if err != nil {
+			return "", false, err
+		}
+		return string(data[:length]), false, nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", false, fmt.Errorf("invalid array length [%s]", line)
+		} else if count < 0 {
+			return "", true, nil
+		} else if count > maxRedisArrayLength {
+			return "", false, fmt.Errorf("array reply of %d elements is too long", count)
+		} else if depth >= maxRedisArrayDepth {
+			return "", false, errors.New("array reply is nested too deeply")
+		}
+		elements := make([]string, count)
+		for i := range elements {
+			elements[i], _, err = readRedisValue(in, depth + 1, remaining)
+			if err != nil {
+				return "", false, err
+			}
+		}
+		return strings.Join(elements, "\n"), false, nil
+	default:
+		return "", false, fmt.Errorf("unexpected reply [%s]", snippet(line, 0))
+	}
+}
+
+// redisInfoField extracts a field from the output of the INFO command.
+func redisInfoField(info string, field string) (string, bool) {
+	for _, line := range strings.Split(info, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) == 2 && parts[0] == field {
+			return parts[1], true
+		}
+	}
+	return "", false
+}
+
+type redisChecker struct{}
+
+func (this redisChecker) Describe() string {
+	return "redis command, optionally verifying the reply or an INFO field"
+}
+
+func (this redisChecker) Parse(data string) (interface{}, error) {
+	var params RedisCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	params.Address = withDefaultPort(params.Address, "6379")
+	if err := validateAddress(params.Address); err != nil {
+		return nil, err
+	} else if params.Username != "" && params.Password == "" {
+		return nil, errors.New("username requires password")
+	} else if params.Database < 0 {
+		return nil, errors.New("database must not be negative")
+	} else if err := validateTlsMode(params.TlsMode); err != nil {
+		return nil, err
+	} else if err := params.loadTls(); err != nil {
+		return nil, err
+	}
+
+	// fix parameters
+	params.Timeout = clampTimeout(params.Timeout)
+	if len(params.Command) == 0 {
+		params.Command = []string{"PING"}
+	}
+	return &params, nil
+}
+
+func (this redisChecker) Run(ctx context.Context, p interface{}, result *CheckResult) error {
+	params := p.(*RedisCheckParams)
+	timeout := time.Duration(params.Timeout) * time.Second
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", params.Address)
+	if err != nil {
+		return fmt.Errorf("connection error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if params.TlsMode == "require" || params.TlsMode == "verify" {
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if params.TlsMode == "verify" {
+			host, _, _ := net.SplitHostPort(params.Address)
+			tlsConfig = params.tlsConfig(host)
+		}
+		tlsConn, err := tlsHandshake(ctx, conn, tlsConfig)
+		if err != nil {
+			return err
+		}
+		conn = tlsConn
+	}
+	in := bufio.NewReader(conn)
+
+	if params.Password != "" {
+		args := []string{"AUTH", params.Password}
+		if params.Username != "" {
+			args = []string{"AUTH", params.Username, params.Password}
+		}
+		if _, _, err := redisCommand(conn, in, args...); err != nil {
+			return fmt.Errorf("AUTH: %v", err)
+		}
+	}
+	if params.Database != 0 {
+		if _, _, err := redisCommand(conn, in, "SELECT", strconv.Itoa(params.Database)); err != nil {
+			return fmt.Errorf("SELECT: %v", err)
+		}
+	}
+
+	command := strings.ToUpper(params.Command[0])
+	reply, isNull, err := redisCommand(conn, in, params.Command...)
+	if err != nil {
+		return fmt.Errorf("%s: %v", command, err)
+	}
+	if params.Field != "" {
+		var ok bool
+		reply, ok = redisInfoField(reply, params.Field)
+		if !ok {
+			return fmt.Errorf("%s reply has no field %s", command, params.Field)
+		}
+	}
+
+	result.Details = map[string]string{"value": snippet(reply, 0)}
+	return params.check(reply, isNull)
+}
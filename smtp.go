@@ -0,0 +1,247 @@
+package gobearmon
+
+import "bufio"
+import "context"
+import "crypto/tls"
+import "encoding/base64"
+import "errors"
+import "fmt"
+import "net"
+import "net/textproto"
+import "strconv"
+import "strings"
+import "time"
+
+// smtpSession is a minimal SMTP client that keeps the code of the last
+// unexpected reply, so that it can be reported.
+type smtpSession struct {
+	conn net.Conn
+	in *bufio.Reader
+	extensions string // reply to the last EHLO
+	failedCode int
+}
+
+func dialSmtp(ctx context.Context, address string, timeout time.Duration, implicitTls bool, tlsConfig *tls.Config) (*smtpSession, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("connection error: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if implicitTls {
+		tlsConn, err := tlsHandshake(ctx, conn, tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return &smtpSession{
+		conn: conn,
+		in: bufio.NewReader(conn),
+	}, nil
+}
+
+func (this *smtpSession) Close() error {
+	return this.conn.Close()
+}
+
+// reply reads a reply and verifies the code.
+func (this *smtpSession) reply(what string, expectCode int) (string, error) {
+	code, message, err := readSmtpReply(this.in, expectCode)
+	if err != nil {
+		if _, ok := err.(*textproto.Error); ok {
+			this.failedCode = code
+			return "", fmt.Errorf("%s: unexpected reply %d %s", what, code, message)
+		}
+		return "", fmt.Errorf("%s: %v", what, err)
+	}
+	return message, nil
+}
+
+// cmd sends a command and reads the reply. If display is set, it is used in
+// place of the command in error messages, to avoid leaking credentials.
+func (this *smtpSession) cmd(command string, display string, expectCode int) (string, error) {
+	if display == "" {
+		display = command
+	}
+	err := writeLine(this.conn, command)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", display, err)
+	}
+	return this.reply(display, expectCode)
+}
+
+func (this *smtpSession) Banner() (string, error) {
+	return this.reply("banner", 220)
+}
+
+func (this *smtpSession) Ehlo(name string) error {
+	message, err := this.cmd("EHLO " + name, "", 250)
+	if err != nil {
+		return err
+	}
+	this.extensions = message
+	return nil
+}
+
+func (this *smtpSession) HasExtension(extension string) bool {
+	return smtpHasExtension(this.extensions, extension)
+}
+
+func (this *smtpSession) StartTls(ctx context.Context, tlsConfig *tls.Config) (*tls.Conn, error) {
+	if !this.HasExtension("STARTTLS") {
+		return nil, errors.New("server does not advertise STARTTLS")
+	} else if _, err := this.cmd("STARTTLS", "", 220); err != nil {
+		return nil, err
+	}
+	tlsConn, err := tlsHandshake(ctx, this.conn, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	this.conn = tlsConn
+	this.in = bufio.NewReader(tlsConn)
+	return tlsConn, nil
+}
+
+// Auth authenticates with the PLAIN or LOGIN mechanism.
+func (this *smtpSession) Auth(mechanism string, username string, password string) error {
+	encode := base64.StdEncoding.EncodeToString
+	if mechanism == "login" {
+		if _, err := this.cmd("AUTH LOGIN", "", 334); err != nil {
+			return err
+		} else if _, err := this.cmd(encode([]byte(username)), "AUTH LOGIN username", 334); err != nil {
+			return err
+		}
+		_, err := this.cmd(encode([]byte(password)), "AUTH LOGIN password", 235)
+		return err
+	}
+	_, err := this.cmd("AUTH PLAIN " + encode([]byte("\x00" + username + "\x00" + password)), "AUTH PLAIN", 235)
+	return err
+}
+
+// SendMail sends a message, which should use CRLF line endings.
+func (this *smtpSession) SendMail(from string, to string, message string) error {
+	if _, err := this.cmd("MAIL FROM:<" + from + ">", "", 250); err != nil {
+		return err
+	} else if _, err := this.cmd("RCPT TO:<" + to + ">", "", 25); err != nil {
+		return err
+	} else if _, err := this.cmd("DATA", "", 354); err != nil {
+		return err
+	}
+
+	// dot-stuff lines that begin with a period
+	lines := strings.Split(strings.TrimSuffix(message, "\r\n"), "\r\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ".") {
+			lines[i] = "." + line
+		}
+	}
+	_, err := this.cmd(strings.Join(lines, "\r\n") + "\r\n.", "end of DATA", 250)
+	return err
+}
+
+func (this *smtpSession) Quit() {
+	this.cmd("QUIT", "", 221)
+}
+
+type smtpChecker struct{}
+
+func (this smtpChecker) Describe() string {
+	return "SMTP server banner, EHLO, STARTTLS and authentication"
+}
+
+func (this smtpChecker) Parse(data string) (interface{}, error) {
+	var params SmtpCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateAddress(params.Address); err != nil {
+		return nil, err
+	} else if err := params.loadTls(); err != nil {
+		return nil, err
+	} else if params.Tls && params.StartTls {
+		return nil, errors.New("tls and starttls cannot both be set")
+	} else if params.Username != "" && !params.Tls && !params.StartTls {
+		return nil, errors.New("refusing to authenticate without tls or starttls")
+	}
+
+	// fix parameters
+	params.Timeout = clampTimeout(params.Timeout)
+	if params.Helo == "" {
+		params.Helo = "gobearmon"
+	}
+	params.AuthMechanism = strings.ToLower(params.AuthMechanism)
+	if params.AuthMechanism == "" {
+		params.AuthMechanism = "plain"
+	} else if params.AuthMechanism != "plain" && params.AuthMechanism != "login" {
+		return nil, fmt.Errorf("unsupported auth_mechanism %s, expected plain or login", params.AuthMechanism)
+	}
+
+	return &params, nil
+}
+
+func (this smtpChecker) Run(ctx context.Context, p interface{}, result *CheckResult) (err error) {
+	params := p.(*SmtpCheckParams)
+	host, _, _ := net.SplitHostPort(params.Address)
+	tlsConfig := params.tlsConfig(host)
+
+	session, err := dialSmtp(ctx, params.Address, time.Duration(params.Timeout) * time.Second, params.Tls, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	result.Details = make(map[string]string)
+	defer func() {
+		if err != nil && session.failedCode != 0 {
+			result.Details["reply_code"] = strconv.Itoa(session.failedCode)
+		}
+	}()
+
+	banner, err := session.Banner()
+	if err != nil {
+		return err
+	} else if params.ExpectBanner != "" && !strings.Contains(banner, params.ExpectBanner) {
+		return fmt.Errorf("banner mismatch, expected [%s] but got [%s]", params.ExpectBanner, banner)
+	} else if err := session.Ehlo(params.Helo); err != nil {
+		return err
+	}
+
+	if params.StartTls {
+		tlsConn, err := session.StartTls(ctx, tlsConfig)
+		if err != nil {
+			return err
+		}
+		result.Details["tls_version"] = tls.VersionName(tlsConn.ConnectionState().Version)
+
+		// extensions may change after STARTTLS
+		if err := session.Ehlo(params.Helo); err != nil {
+			return err
+		}
+	} else if params.Tls {
+		result.Details["tls_version"] = tls.VersionName(session.conn.(*tls.Conn).ConnectionState().Version)
+	}
+
+	var missing []string
+	for _, extension := range params.ExpectExtensions {
+		if !session.HasExtension(extension) {
+			missing = append(missing, extension)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("server does not advertise %s", strings.Join(missing, ", "))
+	}
+
+	if params.Username != "" {
+		err := session.Auth(params.AuthMechanism, params.Username, params.Password)
+		if err != nil {
+			return err
+		}
+	}
+
+	session.Quit()
+	return nil
+}
@@ -0,0 +1,275 @@
+package gobearmon
+
+import "bufio"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "net"
+import "net/textproto"
+import "sort"
+import "strings"
+
+// startTlsFunc performs the plaintext negotiation of a STARTTLS protocol, after
+// which the TLS handshake can begin on conn. Reads must go through in, which
+// wraps conn. The domain is the name of the server, which some protocols
+// need to address the right virtual host.
+type startTlsFunc func(conn net.Conn, in *bufio.Reader, domain string) error
+
+var startTlsFuncs = map[string]startTlsFunc{
+	"smtp": startTlsSmtp,
+	"imap": startTlsImap,
+	"pop3": startTlsPop3,
+	"ftp": startTlsFtp,
+	"xmpp": startTlsXmppClient,
+	"xmpp-server": startTlsXmppServer,
+	"ldap": startTlsLdap,
+	"postgres": startTlsPostgres,
+}
+
+func validateStartTls(protocol string) error {
+	if _, ok := startTlsFuncs[protocol]; !ok {
+		var protocols []string
+		for name := range startTlsFuncs {
+			protocols = append(protocols, name)
+		}
+		sort.Strings(protocols)
+		return fmt.Errorf("unsupported starttls protocol [%s], expected one of %s", protocol, strings.Join(protocols, ", "))
+	}
+	return nil
+}
+
+func startTls(protocol string, conn net.Conn, in *bufio.Reader, domain string) error {
+	err := startTlsFuncs[protocol](conn, in, domain)
+	if err != nil {
+		return fmt.Errorf("%s STARTTLS negotiation failed: %v", protocol, err)
+	}
+	return nil
+}
+
+func writeLine(conn net.Conn, line string) error {
+	_, err := io.WriteString(conn, line + "\r\n")
+	return err
+}
+
+// readLine reads a single CRLF or LF terminated line.
+func readLine(in *bufio.Reader) (string, error) {
+	line, err := in.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readSmtpReply reads a possibly multi-line SMTP or FTP reply and verifies
+// the code; see textproto.Reader.ReadResponse.
+func readSmtpReply(in *bufio.Reader, expectCode int) (int, string, error) {
+	return textproto.NewReader(in).ReadResponse(expectCode)
+}
+
+func startTlsSmtp(conn net.Conn, in *bufio.Reader, domain string) error {
+	session := &smtpSession{conn: conn, in: in}
+	if _, err := session.Banner(); err != nil {
+		return err
+	} else if err := session.Ehlo("gobearmon"); err != nil {
+		return err
+	} else if !session.HasExtension("STARTTLS") {
+		return errors.New("server does not advertise STARTTLS")
+	}
+	_, err := session.cmd("STARTTLS", "", 220)
+	return err
+}
+
+// smtpHasExtension returns whether an EHLO reply advertises an extension.
+func smtpHasExtension(ehloReply string, extension string) bool {
+	for _, line := range strings.Split(ehloReply, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.EqualFold(fields[0], extension) {
+			return true
+		}
+	}
+	return false
+}
+
+func startTlsImap(conn net.Conn, in *bufio.Reader, domain string) error {
+	session := &imapSession{conn: conn, in: in}
+	if err := session.Greeting(); err != nil {
+		return err
+	}
+	_, err := session.cmd("STARTTLS", "")
+	return err
+}
+
+func startTlsPop3(conn net.Conn, in *bufio.Reader, domain string) error {
+	line, err := readLine(in)
+	if err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("unexpected greeting [%s]", line)
+	} else if err := writeLine(conn, "STLS"); err != nil {
+		return err
+	}
+	line, err = readLine(in)
+	if err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("STLS rejected: %s", line)
+	}
+	return nil
+}
+
+func startTlsFtp(conn net.Conn, in *bufio.Reader, domain string) error {
+	if _, _, err := readSmtpReply(in, 220); err != nil {
+		return fmt.Errorf("banner: %v", err)
+	} else if err := writeLine(conn, "AUTH TLS"); err != nil {
+		return err
+	} else if _, _, err := readSmtpReply(in, 234); err != nil {
+		return fmt.Errorf("AUTH TLS: %v", err)
+	}
+	return nil
+}
+
+func startTlsXmppClient(conn net.Conn, in *bufio.Reader, domain string) error {
+	return startTlsXmpp(conn, in, domain, "jabber:client")
+}
+
+func startTlsXmppServer(conn net.Conn, in *bufio.Reader, domain string) error {
+	return startTlsXmpp(conn, in, domain, "jabber:server")
+}
+
+// startTlsXmpp opens a stream and negotiates TLS as in RFC 6120 section 5. We
+// only look for the relevant elements rather than parsing the XML.
+func startTlsXmpp(conn net.Conn, in *bufio.Reader, domain string, namespace string) error {
+	header := fmt.Sprintf("<?xml version='1.0'?><stream:stream to='%s' xmlns='%s' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>", domain, namespace)
+	if _, err := io.WriteString(conn, header); err != nil {
+		return err
+	}
+	features, err := readUntil(in, []byte("</stream:features>"))
+	if err != nil {
+		return fmt.Errorf("reading stream features: %v", err)
+	} else if !strings.Contains(string(features), "urn:ietf:params:xml:ns:xmpp-tls") {
+		return errors.New("server does not offer STARTTLS")
+	}
+	if _, err := io.WriteString(conn, "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>"); err != nil {
+		return err
+	}
+	reply, err := readUntil(in, []byte(">"))
+	if err != nil {
+		return err
+	} else if !strings.Contains(string(reply), "<proceed") {
+		return fmt.Errorf("STARTTLS rejected: %s", strings.TrimSpace(string(reply)))
+	}
+	return nil
+}
+
+// BER encoding of an LDAP StartTLS extended request with message ID 1, see
+// RFC 4511 section 4.14.
+var ldapStartTlsRequest = []byte("\x30\x1d\x02\x01\x01\x77\x18\x80\x16" + "1.3.6.1.4.1.1466.20037")
+
+func startTlsLdap(conn net.Conn, in *bufio.Reader, domain string) error {
+	if _, err := conn.Write(ldapStartTlsRequest); err != nil {
+		return err
+	}
+
+	// LDAPMessage: SEQUENCE { messageID, extendedResp [APPLICATION 24] { resultCode, ... } }
+	tag, message, err := readBer(in)
+	if err != nil {
+		return err
+	} else if tag != 0x30 {
+		return fmt.Errorf("unexpected response tag 0x%02x", tag)
+	}
+	for len(message) > 0 {
+		var content []byte
+		tag, content, message, err = parseBer(message)
+		if err != nil {
+			return err
+		} else if tag != 0x78 {
+			continue
+		}
+		_, code, _, err := parseBer(content)
+		if err != nil {
+			return err
+		} else if len(code) != 1 {
+			return errors.New("invalid result code")
+		} else if code[0] != 0 {
+			return fmt.Errorf("StartTLS rejected with result code %d", code[0])
+		}
+		return nil
+	}
+	return errors.New("response is not an extended response")
+}
+
+// readBer reads a BER element and returns its tag and content.
+func readBer(in *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[1])
+	if length & 0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 {
+			return 0, nil, fmt.Errorf("unsupported BER length encoding 0x%02x", header[1])
+		}
+		lengthBytes := make([]byte, n)
+		if _, err := io.ReadFull(in, lengthBytes); err != nil {
+			return 0, nil, err
+		}
+		length = 0
+		for _, b := range lengthBytes {
+			length = length << 8 | int(b)
+		}
+	}
+	if length > maxTcpReadBytes {
+		return 0, nil, fmt.Errorf("BER element of %d bytes is too long", length)
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(in, content); err != nil {
+		return 0, nil, err
+	}
+	return header[0], content, nil
+}
+
+// parseBer splits the first BER element from data.
+func parseBer(data []byte) (tag byte, content []byte, rest []byte, err error) {
+	if len(data) < 2 {
+		return 0, nil, nil, errors.New("truncated BER element")
+	}
+	length := int(data[1])
+	offset := 2
+	if length & 0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 || len(data) < 2 + n {
+			return 0, nil, nil, fmt.Errorf("unsupported BER length encoding 0x%02x", data[1])
+		}
+		length = 0
+		for _, b := range data[2:2 + n] {
+			length = length << 8 | int(b)
+		}
+		offset += n
+	}
+	if len(data) - offset < length {
+		return 0, nil, nil, errors.New("truncated BER element")
+	}
+	return data[0], data[offset:offset + length], data[offset + length:], nil
+}
+
+// startTlsPostgres sends an SSLRequest, see "SSL Session Encryption" in the
+// PostgreSQL protocol documentation.
+func startTlsPostgres(conn net.Conn, in *bufio.Reader, domain string) error {
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], 80877103)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reply, err := in.ReadByte()
+	if err != nil {
+		return err
+	} else if reply == 'N' {
+		return errors.New("server does not support SSL")
+	} else if reply != 'S' {
+		return fmt.Errorf("unexpected reply 0x%02x", reply)
+	}
+	return nil
+}
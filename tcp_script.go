@@ -0,0 +1,151 @@
+package gobearmon
+
+import "bufio"
+import "bytes"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "io"
+import "net"
+import "time"
+import "unicode"
+import "unicode/utf8"
+
+// maximum number of steps in a tcp script
+const maxTcpScriptSteps = 20
+
+// maximum number of bytes read by a single tcp script step
+const maxTcpReadBytes = 1024 * 1024
+
+// prepare validates the step and decodes hex values; it must be called from
+// the check type's Parse.
+func (this *TcpStep) prepare() error {
+	if this.Send != "" && this.SendHex != "" {
+		return errors.New("send and send_hex cannot both be set")
+	} else if this.Expect != "" && this.ExpectHex != "" {
+		return errors.New("expect and expect_hex cannot both be set")
+	} else if this.ReadBytes != 0 && (this.ReadUntil != "" || this.ReadUntilHex != "") {
+		return errors.New("read_bytes cannot be combined with read_until")
+	} else if this.ReadUntil != "" && this.ReadUntilHex != "" {
+		return errors.New("read_until and read_until_hex cannot both be set")
+	} else if this.ReadBytes < 0 || this.ReadBytes > maxTcpReadBytes {
+		return fmt.Errorf("read_bytes must be between 0 and %d", maxTcpReadBytes)
+	} else if err := this.compile(); err != nil {
+		return err
+	}
+
+	var err error
+	this.send = []byte(this.Send)
+	if this.SendHex != "" {
+		this.send, err = hex.DecodeString(this.SendHex)
+		if err != nil {
+			return fmt.Errorf("invalid send_hex: %v", err)
+		}
+	}
+	this.expect = []byte(this.Expect)
+	if this.ExpectHex != "" {
+		this.expect, err = hex.DecodeString(this.ExpectHex)
+		if err != nil {
+			return fmt.Errorf("invalid expect_hex: %v", err)
+		}
+	}
+	this.readUntil = []byte(this.ReadUntil)
+	if this.ReadUntilHex != "" {
+		this.readUntil, err = hex.DecodeString(this.ReadUntilHex)
+		if err != nil {
+			return fmt.Errorf("invalid read_until_hex: %v", err)
+		}
+	}
+
+	// fix parameters
+	if this.Timeout != 0 {
+		this.Timeout = clampTimeout(this.Timeout)
+	}
+	if this.ReadBytes == 0 && len(this.readUntil) == 0 && this.reads() {
+		this.readUntil = []byte("\n")
+	}
+	return nil
+}
+
+// reads returns whether the step reads a response after sending.
+func (this *TcpStep) reads() bool {
+	return this.ReadBytes > 0 || len(this.readUntil) > 0 || len(this.expect) > 0 || this.active()
+}
+
+func (this *TcpStep) run(conn net.Conn, in *bufio.Reader, timeout time.Duration) error {
+	if this.Timeout != 0 {
+		timeout = time.Duration(this.Timeout) * time.Second
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if len(this.send) > 0 {
+		_, err := conn.Write(this.send)
+		if err != nil {
+			return fmt.Errorf("failed to send: %v", err)
+		}
+	}
+
+	if !this.reads() {
+		return nil
+	}
+
+	var received []byte
+	var err error
+	if this.ReadBytes > 0 {
+		received = make([]byte, this.ReadBytes)
+		var n int
+		n, err = io.ReadFull(in, received)
+		received = received[:n]
+	} else {
+		received, err = readUntil(in, this.readUntil)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v (received [%s])", err, displayBytes(received))
+	}
+
+	if !bytes.Contains(received, this.expect) {
+		return fmt.Errorf("response mismatch, expected [%s] but got [%s]", displayBytes(this.expect), displayBytes(received))
+	}
+	return this.match(string(received), "response")
+}
+
+// readUntil reads until the delimiter, which is included in the result. It
+// reads in pieces of at most the buffer size, so that a peer that never sends
+// the delimiter cannot make us buffer more than maxTcpReadBytes.
+func readUntil(in *bufio.Reader, delimiter []byte) ([]byte, error) {
+	var received []byte
+	last := delimiter[len(delimiter) - 1]
+	for {
+		piece, err := in.ReadSlice(last)
+		if len(received) + len(piece) > maxTcpReadBytes {
+			return received, fmt.Errorf("delimiter not found in first %d bytes", maxTcpReadBytes)
+		}
+		received = append(received, piece...)
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return received, err
+		} else if bytes.HasSuffix(received, delimiter) {
+			return received, nil
+		}
+	}
+}
+
+// displayBytes formats data for a message, as text if it is printable or else
+// as hex.
+func displayBytes(data []byte) string {
+	printable := utf8.Valid(data)
+	for _, r := range string(data) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			printable = false
+			break
+		}
+	}
+	if printable {
+		return snippet(string(data), 0)
+	}
+	if len(data) > snippetLength / 2 {
+		return "hex:" + hex.EncodeToString(data[:snippetLength / 2]) + "..."
+	}
+	return "hex:" + hex.EncodeToString(data)
+}
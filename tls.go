@@ -0,0 +1,93 @@
+package gobearmon
+
+import "context"
+import "crypto/tls"
+import "crypto/x509"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "net"
+import "strings"
+
+// TlsParams can be embedded in check parameters to configure certificate
+// verification and client certificates. The PEM options accept either inline
+// PEM data or the path of a PEM file on the worker.
+type TlsParams struct {
+	Insecure bool `json:"insecure"` // skip certificate verification
+	ServerName string `json:"server_name"` // SNI name, also used to verify the certificate
+	CaBundle string `json:"ca_bundle"` // trust these CAs instead of the system roots
+	ClientCert string `json:"client_cert"`
+	ClientKey string `json:"client_key"`
+
+	rootCAs *x509.CertPool
+	certificates []tls.Certificate
+}
+
+func readPEM(value string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+// loadTls validates the options and loads certificates; it must be called from
+// the check type's Parse.
+func (this *TlsParams) loadTls() error {
+	this.rootCAs = nil
+	this.certificates = nil
+
+	if this.CaBundle != "" {
+		bytes, err := readPEM(this.CaBundle)
+		if err != nil {
+			return fmt.Errorf("failed to read ca_bundle: %v", err)
+		}
+		this.rootCAs = x509.NewCertPool()
+		if !this.rootCAs.AppendCertsFromPEM(bytes) {
+			return errors.New("ca_bundle does not contain any PEM certificates")
+		}
+	}
+
+	if (this.ClientCert == "") != (this.ClientKey == "") {
+		return errors.New("client_cert and client_key must be set together")
+	} else if this.ClientCert != "" {
+		certBytes, err := readPEM(this.ClientCert)
+		if err != nil {
+			return fmt.Errorf("failed to read client_cert: %v", err)
+		}
+		keyBytes, err := readPEM(this.ClientKey)
+		if err != nil {
+			return fmt.Errorf("failed to read client_key: %v", err)
+		}
+		cert, err := tls.X509KeyPair(certBytes, keyBytes)
+		if err != nil {
+			return fmt.Errorf("invalid client certificate: %v", err)
+		}
+		this.certificates = []tls.Certificate{cert}
+	}
+
+	return nil
+}
+
+// tlsConfig returns a new TLS configuration. The server name is used for SNI
+// and verification unless overridden by the server_name option.
+func (this *TlsParams) tlsConfig(serverName string) *tls.Config {
+	if this.ServerName != "" {
+		serverName = this.ServerName
+	}
+	return &tls.Config{
+		ServerName: serverName,
+		InsecureSkipVerify: this.Insecure,
+		RootCAs: this.rootCAs,
+		Certificates: this.certificates,
+	}
+}
+
+// tlsHandshake performs a client TLS handshake over an established connection.
+func tlsHandshake(ctx context.Context, conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	tlsConn := tls.Client(conn, config)
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	return tlsConn, nil
+}
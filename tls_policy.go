@@ -0,0 +1,366 @@
+package gobearmon
+
+import "bufio"
+import "context"
+import "crypto/ecdsa"
+import "crypto/rsa"
+import "crypto/tls"
+import "crypto/x509"
+import "errors"
+import "fmt"
+import "net"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+// protocol versions probed by the tls_policy check, oldest first
+var tlsPolicyVersions = []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+
+// what the tls_policy check cannot see, since crypto/tls cannot offer it; a
+// passing result says nothing about these
+const tlsPolicyNotProbed = "SSLv3 and DHE, NULL, EXPORT and CAMELLIA cipher suites"
+
+// number of handshakes that the tls_policy check performs concurrently
+const tlsPolicyConcurrency = 4
+
+// parseTlsVersion accepts versions like 1.2, TLS 1.2 or tls1.2.
+func parseTlsVersion(str string) (uint16, error) {
+	version := strings.TrimSpace(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(str)), "tls"))
+	switch version {
+	case "1.0", "1":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %s, expected 1.0, 1.1, 1.2 or 1.3", str)
+}
+
+// tlsCipherSuites returns all cipher suites implemented by crypto/tls,
+// including insecure ones, and which of them are insecure.
+func tlsCipherSuites() ([]*tls.CipherSuite, map[uint16]bool) {
+	insecure := make(map[uint16]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.ID] = true
+	}
+	return append(tls.CipherSuites(), tls.InsecureCipherSuites()...), insecure
+}
+
+type tlsPolicyChecker struct{}
+
+func (this tlsPolicyChecker) Describe() string {
+	return "TLS protocol versions, cipher suites and certificate keys against a policy (not probed: " + tlsPolicyNotProbed + ")"
+}
+
+func (this tlsPolicyChecker) Parse(data string) (interface{}, error) {
+	var params TlsPolicyCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateAddress(params.Address); err != nil {
+		return nil, err
+	} else if params.MinRsaKeySize < 0 || params.MinEcdsaKeySize < 0 {
+		return nil, errors.New("key sizes must be non-negative")
+	} else if len(params.AllowedCiphers) > 0 && len(params.ForbiddenCiphers) > 0 {
+		return nil, errors.New("allowed_ciphers and forbidden_ciphers cannot both be set")
+	}
+	if params.StartTls != "" {
+		if err := validateStartTls(params.StartTls); err != nil {
+			return nil, err
+		}
+	}
+	if params.MinVersion != "" {
+		params.minVersion, err = parseTlsVersion(params.MinVersion)
+		if err != nil {
+			return nil, fmt.Errorf("min_version: %v", err)
+		}
+	}
+	params.requireVersions = nil
+	for _, str := range params.RequireVersions {
+		version, err := parseTlsVersion(str)
+		if err != nil {
+			return nil, fmt.Errorf("require_versions: %v", err)
+		}
+		params.requireVersions = append(params.requireVersions, version)
+	}
+	suites, _ := tlsCipherSuites()
+	for _, name := range params.AllowedCiphers {
+		var found bool
+		for _, suite := range suites {
+			found = found || suite.Name == name
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown cipher suite %s in allowed_ciphers", name)
+		}
+	}
+
+	// fix parameters
+	if params.Timeout == 0 {
+		params.Timeout = 5
+	}
+	params.Timeout = clampTimeout(params.Timeout)
+	// one round of version probes, then the cipher suite probes of every
+	// version that may be accepted
+	rounds := 1
+	if len(params.AllowedCiphers) > 0 || len(params.ForbiddenCiphers) > 0 || params.RejectInsecureCiphers {
+		var probes int
+		for _, suite := range suites {
+			for _, version := range suite.SupportedVersions {
+				if version != tls.VersionTLS13 {
+					probes++
+				}
+			}
+		}
+		rounds += (probes + tlsPolicyConcurrency - 1) / tlsPolicyConcurrency
+	}
+	if total := rounds * params.Timeout; time.Duration(total) * time.Second > checkTimeout {
+		return nil, fmt.Errorf("check may take up to %d seconds, reduce the timeout", total)
+	}
+	return &params, nil
+}
+
+// countingConn records whether the server has sent anything.
+type countingConn struct {
+	net.Conn
+	received int
+}
+
+func (this *countingConn) Read(b []byte) (int, error) {
+	n, err := this.Conn.Read(b)
+	this.received += n
+	return n, err
+}
+
+// isHandshakeRejection reports whether a handshake error means that the
+// server refused the offered version or cipher suites: either it sent a TLS
+// alert, or it selected a version or cipher suite that was not offered.
+func isHandshakeRejection(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		return true
+	}
+	msg := err.Error()
+	return strings.HasPrefix(msg, "tls: server") && (strings.Contains(msg, "version") || strings.Contains(msg, "cipher suite"))
+}
+
+// handshake connects and attempts a TLS handshake with the given version and
+// cipher suites. A nil state means that the server rejected the handshake;
+// timeouts, resets and other failures are returned as errors.
+func (this tlsPolicyChecker) handshake(ctx context.Context, params *TlsPolicyCheckParams, version uint16, suites []uint16) (*tls.ConnectionState, error) {
+	// the timeout covers the whole probe, so that Parse can bound the run time
+	deadline := time.Now().Add(time.Duration(params.Timeout) * time.Second)
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", params.Address)
+	if err != nil {
+		return nil, fmt.Errorf("connection error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	serverName := params.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(params.Address)
+	}
+	if params.StartTls != "" {
+		err := startTls(params.StartTls, conn, bufio.NewReader(conn), serverName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	counting := &countingConn{Conn: conn}
+	tlsConn := tls.Client(counting, &tls.Config{
+		ServerName: serverName,
+		InsecureSkipVerify: true,
+		MinVersion: version,
+		MaxVersion: version,
+		CipherSuites: suites,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		var netErr net.Error
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if isHandshakeRejection(err) {
+			return nil, nil
+		} else if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("%s handshake timed out", tls.VersionName(version))
+		} else if counting.received == 0 {
+			return nil, fmt.Errorf("%s handshake failed before the server responded: %v", tls.VersionName(version), err)
+		}
+		return nil, fmt.Errorf("%s handshake failed: %v", tls.VersionName(version), err)
+	}
+	state := tlsConn.ConnectionState()
+	return &state, nil
+}
+
+func (this tlsPolicyChecker) Run(ctx context.Context, p interface{}, result *CheckResult) error {
+	params := p.(*TlsPolicyCheckParams)
+	suites, insecure := tlsCipherSuites()
+	var allSuites []uint16
+	for _, suite := range suites {
+		allSuites = append(allSuites, suite.ID)
+	}
+
+	// probe versions and then, if the policy restricts them, the cipher
+	// suites of each accepted version; TLS 1.3 suites cannot be selected
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var probeErr error
+	states := make(map[uint16]*tls.ConnectionState)
+	accepted := make(map[uint16]map[uint16]bool)
+	semaphore := make(chan bool, tlsPolicyConcurrency)
+	probe := func(version uint16, suites []uint16, cipher uint16) {
+		defer wg.Done()
+		semaphore <- true
+		defer func() { <-semaphore }()
+		state, err := this.handshake(ctx, params, version, suites)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			probeErr = err
+		} else if state != nil && cipher == 0 {
+			states[version] = state
+			accepted[version] = map[uint16]bool{state.CipherSuite: true}
+		} else if state != nil {
+			accepted[version][cipher] = true
+		}
+	}
+
+	for _, version := range tlsPolicyVersions {
+		wg.Add(1)
+		go probe(version, allSuites, 0)
+	}
+	wg.Wait()
+	if probeErr != nil {
+		return probeErr
+	} else if len(states) == 0 {
+		return errors.New("server did not accept any TLS version")
+	}
+
+	if len(params.AllowedCiphers) > 0 || len(params.ForbiddenCiphers) > 0 || params.RejectInsecureCiphers {
+		for version := range states {
+			if version == tls.VersionTLS13 {
+				continue
+			}
+			for _, suite := range suites {
+				for _, supported := range suite.SupportedVersions {
+					if supported == version {
+						wg.Add(1)
+						go probe(version, []uint16{suite.ID}, suite.ID)
+					}
+				}
+			}
+		}
+		wg.Wait()
+		if probeErr != nil {
+			return probeErr
+		}
+	}
+
+	var versionNames []string
+	var cipherNames []string
+	var violations []string
+	for _, version := range tlsPolicyVersions {
+		if states[version] == nil {
+			continue
+		}
+		versionNames = append(versionNames, tls.VersionName(version))
+		if params.minVersion != 0 && version < params.minVersion {
+			violations = append(violations, fmt.Sprintf("%s is accepted", tls.VersionName(version)))
+		}
+
+		var ids []uint16
+		for id := range accepted[version] {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			name := tls.CipherSuiteName(id)
+			cipherNames = append(cipherNames, tls.VersionName(version) + " " + name)
+			if reason := this.cipherViolation(params, name, insecure[id]); reason != "" {
+				violations = append(violations, fmt.Sprintf("%s is accepted with %s (%s)", name, tls.VersionName(version), reason))
+			}
+		}
+	}
+	for _, version := range params.requireVersions {
+		if states[version] == nil {
+			violations = append(violations, fmt.Sprintf("%s is not accepted", tls.VersionName(version)))
+		}
+	}
+
+	// certificates from the newest accepted version
+	var state *tls.ConnectionState
+	for _, version := range tlsPolicyVersions {
+		if states[version] != nil {
+			state = states[version]
+		}
+	}
+	for i, cert := range state.PeerCertificates {
+		violations = append(violations, this.certificateViolations(params, cert, i)...)
+	}
+
+	result.Details = map[string]string{
+		"versions": strings.Join(versionNames, ", "),
+		"ciphers": strings.Join(cipherNames, ", "),
+		"not_probed": tlsPolicyNotProbed,
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("policy violations: %s", strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// cipherViolation returns why the cipher suite violates the policy, if it does.
+func (this tlsPolicyChecker) cipherViolation(params *TlsPolicyCheckParams, name string, insecure bool) string {
+	if params.RejectInsecureCiphers && insecure {
+		return "insecure"
+	}
+	if len(params.AllowedCiphers) > 0 && !strings.HasPrefix(name, "TLS_AES_") && !strings.HasPrefix(name, "TLS_CHACHA20_") {
+		for _, allowed := range params.AllowedCiphers {
+			if name == allowed {
+				return ""
+			}
+		}
+		return "not allowed"
+	}
+	for _, forbidden := range params.ForbiddenCiphers {
+		if strings.Contains(name, forbidden) {
+			return "forbidden by " + forbidden
+		}
+	}
+	return ""
+}
+
+// certificateViolations checks the key size and signature algorithm of a
+// served certificate; index 0 is the server certificate.
+func (this tlsPolicyChecker) certificateViolations(params *TlsPolicyCheckParams, cert *x509.Certificate, index int) []string {
+	name := "certificate"
+	if index > 0 {
+		name = fmt.Sprintf("chain certificate %d", index)
+	}
+	name += " (" + certificateName(cert) + ")"
+
+	var violations []string
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if bits := key.N.BitLen(); bits < params.MinRsaKeySize {
+			violations = append(violations, fmt.Sprintf("%s has a %d bit RSA key", name, bits))
+		}
+	case *ecdsa.PublicKey:
+		if bits := key.Curve.Params().BitSize; bits < params.MinEcdsaKeySize {
+			violations = append(violations, fmt.Sprintf("%s has a %d bit ECDSA key", name, bits))
+		}
+	}
+	for _, algorithm := range params.ForbiddenSignatureAlgorithms {
+		if strings.EqualFold(cert.SignatureAlgorithm.String(), algorithm) {
+			violations = append(violations, fmt.Sprintf("%s is signed with %s", name, cert.SignatureAlgorithm))
+		}
+	}
+	return violations
+}
@@ -0,0 +1,116 @@
+package gobearmon
+
+import "bytes"
+import "context"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "net"
+import "strconv"
+import "syscall"
+import "time"
+
+// maximum number of retries in a udp check
+const maxUdpRetries = 10
+
+type udpChecker struct{}
+
+func (this udpChecker) Describe() string {
+	return "UDP datagram, verifying that a matching response arrives"
+}
+
+func (this udpChecker) Parse(data string) (interface{}, error) {
+	var params UdpCheckParams
+	err := decodeParams(data, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateAddress(params.Address); err != nil {
+		return nil, err
+	} else if err := validateForceIP(params.ForceIP); err != nil {
+		return nil, err
+	} else if params.Payload != "" && params.PayloadHex != "" {
+		return nil, errors.New("payload and payload_hex cannot both be set")
+	} else if params.Expect != "" && params.ExpectHex != "" {
+		return nil, errors.New("expect and expect_hex cannot both be set")
+	} else if params.Retries < 0 || params.Retries > maxUdpRetries {
+		return nil, fmt.Errorf("retries must be between 0 and %d", maxUdpRetries)
+	} else if err := params.compile(); err != nil {
+		return nil, err
+	}
+
+	params.payload = []byte(params.Payload)
+	if params.PayloadHex != "" {
+		params.payload, err = hex.DecodeString(params.PayloadHex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload_hex: %v", err)
+		}
+	}
+	params.expect = []byte(params.Expect)
+	if params.ExpectHex != "" {
+		params.expect, err = hex.DecodeString(params.ExpectHex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expect_hex: %v", err)
+		}
+	}
+
+	// fix parameters
+	params.Timeout = clampTimeout(params.Timeout)
+	if time.Duration((params.Retries + 1) * params.Timeout) * time.Second > checkTimeout {
+		return nil, fmt.Errorf("retries may take up to %d seconds, reduce the number of retries or the timeout", (params.Retries + 1) * params.Timeout)
+	}
+	return &params, nil
+}
+
+func (this udpChecker) Run(ctx context.Context, p interface{}, result *CheckResult) error {
+	params := p.(*UdpCheckParams)
+	timeout := time.Duration(params.Timeout) * time.Second
+
+	network := "udp"
+	if params.ForceIP == 4 {
+		network = "udp4"
+	} else if params.ForceIP == 6 {
+		network = "udp6"
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, params.Address)
+	if err != nil {
+		return fmt.Errorf("UDP connection error: %v", err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 65536)
+	for attempt := 1; attempt <= params.Retries + 1; attempt++ {
+		start := time.Now()
+		_, err := conn.Write(params.payload)
+		if err != nil {
+			return fmt.Errorf("failed to send payload: %v", err)
+		}
+		conn.SetReadDeadline(start.Add(timeout))
+		n, err := conn.Read(buf)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		} else if errors.Is(err, syscall.ECONNREFUSED) {
+			return errors.New("port unreachable")
+		} else if err != nil {
+			return fmt.Errorf("failed to read response: %v", err)
+		}
+
+		result.Duration = time.Since(start)
+		if attempt > 1 {
+			result.Details = map[string]string{"attempts": strconv.Itoa(attempt)}
+		}
+		received := buf[:n]
+		if !bytes.Contains(received, params.expect) {
+			return fmt.Errorf("response mismatch, expected [%s] but got [%s]", displayBytes(params.expect), displayBytes(received))
+		}
+		return params.match(string(received), "response")
+	}
+
+	return fmt.Errorf("no response after %d attempts", params.Retries + 1)
+}